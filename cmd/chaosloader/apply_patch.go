@@ -1,107 +1,173 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"strconv"
 
-	"github.com/siemens-mobile-hacks/siepatcher/pkg/patcheskibabcom"
-	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patcher"
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
 )
 
-func DoApplyPatch(loader pmb887x.ChaosLoaderInterface, patchFile string, isRevert, isDryRun, isForce bool) error {
-	var pr *patchreader.PatchReader
-	// Load a patch.
-	patchID, err := strconv.ParseInt(patchFile, 10, 64)
-	if err != nil {
-		pr, err = patchreader.FromFile(patchFile)
-	} else {
-		patchText, err := patcheskibabcom.PatchByID(int(patchID))
+// DoApplyPatch applies (or reverts) all patchFiles at once: every erase block is written only once.
+func DoApplyPatch(ctx context.Context, loader pmb887x.ChaosLoaderInterface, patchFiles []string, backupDir, ledgerDir, journalDir string, protected []patcher.ProtectedRegion, isRevert, isDryRun, isForce bool) error {
+	var patches []patcher.NamedPatch
+	for _, patchFile := range patchFiles {
+		pr, err := patcher.Load(patchFile)
 		if err != nil {
-			return err
-		}
-		if pr, err = patchreader.FromString(patchText); err != nil {
-			return err
+			return fmt.Errorf("%s: %w", patchFile, err)
 		}
+		patches = append(patches, patcher.NamedPatch{Name: patcher.PatchName(patchFile), Patch: pr})
 	}
+	log.Printf("Loaded and parsed %d patches successfully", len(patches))
+
+	plan, err := patcher.PrepareMany(ctx, loader, patches, isRevert)
 	if err != nil {
-		log.Fatalf("Cannot load patch: %v", err)
+		return err
+	}
+	for _, block := range plan.Blocks {
+		fmt.Printf("Patch touches block @ %X size %X\n", block.Addr, len(block.Data))
+	}
+	for _, addr := range plan.NoUndo {
+		fmt.Printf("Chunk @ %X can't be undone, leaving it as is\n", addr)
+	}
+	for _, o := range plan.Overlaps {
+		if o.Conflict {
+			fmt.Printf("Conflict @ %X: %s and %s change it differently\n", o.Addr, o.First, o.Second)
+		} else {
+			log.Printf("Byte @ %X is changed by both %s and %s in the same way", o.Addr, o.First, o.Second)
+		}
+	}
+	for _, m := range plan.Mismatches {
+		log.Printf("Data at addr 0x%X is %X, expected %X\n", m.Addr, m.Got, m.Want)
+	}
+	for _, h := range patcher.ChunkHits(plan.Info, patches, protected, isRevert) {
+		fmt.Printf("Chunk @ %X of %s is in an erase block of protected region %q\n", h.Chunk, h.Patch, h.Region)
+	}
+	reports := plan.Reports(patches)
+	for _, r := range reports {
+		fmt.Printf("%s: %d chunks ready, %d already done, %d don't match, %d can't be undone\n", r.Name,
+			r.Count(patcher.ChunkReady), r.Count(patcher.ChunkDone), r.Count(patcher.ChunkMismatch), r.Count(patcher.ChunkNoUndo))
+	}
+	if !plan.CanApply() && isForce {
+		log.Printf("Old data doesn't match in %d bytes, %d bytes conflict. Proceeding anyway...", len(plan.Mismatches), len(plan.Conflicts()))
 	}
-	log.Printf("Loaded and parsed the patch successfully")
 
-	flashInfo, err := loader.ReadInfo()
-	if err != nil {
+	// Nothing is saved or written for a plan that is refused anyway.
+	if err := plan.CheckProtected(protected); err != nil {
 		return err
 	}
-	blockMapper := flashInfo.BlockMap
-	var blockCache map[int64][]byte = map[int64][]byte{}
-	// Figure out what blocks need to be modified.
-	patchChunks := pr.Chunks()
 
-	for _, chunk := range patchChunks {
-		for addr := chunk.BaseAddr; addr < chunk.EndAddr(); addr++ {
-			baseAddr, size, err := blockMapper.ParamsForAddr(addr + blockMapper.BaseAddr())
-			if err != nil {
-				log.Fatalf("Error when mapping patch chunks to blocks: %v", err)
-			}
-			if _, ok := blockCache[baseAddr]; ok {
-				// This block is cached.
-				continue
-			}
-			fmt.Printf("Need to request block @ %X size %X\n", baseAddr, size)
-			blockCache[baseAddr] = make([]byte, size)
-			if err := loader.ReadFlash(int64(baseAddr), blockCache[baseAddr]); err != nil {
-				fmt.Printf("\n\tError reading flash @ %08X: %v\n", baseAddr, err)
-			}
+	var backupPath string
+	if !isDryRun && (plan.CanApply() || isForce) {
+		backupPath, err = patcher.NewBackup(plan.Info, plan).Save(backupDir)
+		if err != nil {
+			return fmt.Errorf("cannot back up blocks before writing: %w", err)
 		}
+		fmt.Printf("Original blocks saved to %s\n", backupPath)
 	}
 
-	for _, chunk := range patchChunks {
-		for addr := chunk.BaseAddr; addr < chunk.EndAddr(); addr++ {
-			// Get the base address of the block the current address is in.
-			// This is also an index in our blockCache map.
-			blockBaseAddr, _, _ := blockMapper.ParamsForAddr(addr + blockMapper.BaseAddr())
-			// Offset inside the cached block.
-			cachedBlockOff := blockMapper.BaseAddr() + addr - blockBaseAddr
-			// Data offset inside the patch chunk.
-			dataOff := addr - chunk.BaseAddr
-			//fmt.Printf("\naddr=%08X, blockBaseAddr=%08X, cachedBlockOff=%08X, dataOff=%08X\n", addr, blockBaseAddr, cachedBlockOff, dataOff)
-			gotOldData := &blockCache[blockBaseAddr][cachedBlockOff]
-			var wantOldData, newData byte
-
-			if !isRevert {
-				wantOldData = chunk.OldData[dataOff]
-				newData = chunk.NewData[dataOff]
-			} else {
-				wantOldData = chunk.NewData[dataOff]
-				newData = chunk.OldData[dataOff]
-			}
-			if *gotOldData != wantOldData {
-				if isForce {
-					log.Printf("Data at addr 0x%X is %X, expected %X. Proceeding anyway...\n", addr, *gotOldData, wantOldData)
-				} else {
-					return fmt.Errorf("data at addr 0x%X is %X, expected %X", addr, *gotOldData, wantOldData)
-				}
-			}
-			*gotOldData = newData
+	res, err := patcher.Execute(ctx, loader, plan, patcher.Options{Revert: isRevert, DryRun: isDryRun, Force: isForce, JournalDir: journalDir, Protected: protected})
+	if err != nil {
+		var blockErr *patcher.BlockError
+		if errors.As(err, &blockErr) {
+			fmt.Printf("Blocks written before the error: %d of %d\n", len(res.Written), len(plan.Blocks))
 		}
+		return err
 	}
-	fmt.Println("Patch can be applied!")
 	if isDryRun {
+		fmt.Println("Patch can be applied!")
 		return nil
 	}
+	for _, addr := range res.Written {
+		fmt.Printf("Written block @ %08X\n", addr)
+	}
+	for _, addr := range res.Skipped {
+		fmt.Printf("Block @ %08X already has the data, not written\n", addr)
+	}
+	forced := make([]bool, len(reports))
+	for i, r := range reports {
+		s := r.Summary(res)
+		fmt.Printf("%s: %d chunks written, %d already there, %d written over data that didn't match, %d left as is\n",
+			r.Name, s.Written, s.Present, s.Forced, s.Left)
+		forced[i] = s.Forced > 0
+	}
+	fmt.Println("Patch applied!")
 
-	// Now all blocks in our blockCache are patched.
-	// Time to send them back to the phone.
-	for addr, block := range blockCache {
-		fmt.Printf("Writing block @ %08X len %08X\n", addr, len(block))
-		if err := loader.WriteFlash(addr, block); err != nil {
-			fmt.Printf("Error writing block: %v\n", err)
+	if ledgerDir != "" {
+		if err := recordPatches(ledgerDir, plan.Info, patches, forced, isRevert, backupPath); err != nil {
+			fmt.Printf("Cannot record the patch in the ledger: %v\n", err)
 		}
 	}
+	return nil
+}
 
-	fmt.Println("Patch applied!")
+// recordPatches notes in the device ledger that the patches were applied or reverted.
+// The patches written over data that didn't match are marked as forced.
+func recordPatches(ledgerDir string, info pmb887x.ChaosPhoneInfo, patches []patcher.NamedPatch, forced []bool, isRevert bool, backupPath string) error {
+	path := patcher.LedgerPath(ledgerDir, info)
+	ledger, err := patcher.LoadLedger(path, info)
+	if err != nil {
+		return err
+	}
+	for i, p := range patches {
+		e := ledger.Record(p.Name, p.Patch.Chunks(), isRevert, backupPath)
+		if forced[i] {
+			e.MarkForced()
+		}
+	}
+	return ledger.Save(path)
+}
+
+// DoStatus checks if the patches recorded in the device ledger are still in flash.
+func DoStatus(ctx context.Context, loader pmb887x.ChaosLoaderInterface, info pmb887x.ChaosPhoneInfo, ledgerDir string) error {
+	path := patcher.LedgerPath(ledgerDir, info)
+	ledger, err := patcher.LoadLedger(path, info)
+	if err != nil {
+		return err
+	}
+	if len(ledger.Patches) == 0 {
+		fmt.Printf("No patches recorded for this phone in %s\n", path)
+		return nil
+	}
+	for _, entry := range ledger.Patches {
+		action := "applied"
+		if !entry.Installed {
+			action = "reverted"
+		}
+		st, err := entry.CheckInstalled(ctx, loader, info)
+		if err != nil {
+			return fmt.Errorf("cannot check %q: %w", entry.Name, err)
+		}
+		line := fmt.Sprintf("%-18s %s (%s %s", st.State, entry.Name, action, entry.Updated().Format("2006-01-02 15:04"))
+		if entry.LastEvent().Forced {
+			line += " over data that didn't match"
+		}
+		switch st.State {
+		case patcher.PartiallyInstalled:
+			line += fmt.Sprintf(", %d of %d chunks applied", st.AppliedChunks, st.TotalChunks)
+		case patcher.Conflicting:
+			line += fmt.Sprintf(", %d bytes are changed by something else", st.Conflicts)
+		}
+		fmt.Println(line + ")")
+	}
+	return nil
+}
 
+func DoRestoreBackup(ctx context.Context, loader pmb887x.ChaosLoaderInterface, backupPath, journalDir string, protected []patcher.ProtectedRegion, isDryRun, isForce bool) error {
+	backup, err := patcher.ReadBackup(backupPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backup of %s (IMEI %s) made %v, %d blocks\n", backup.Model, backup.IMEI, backup.Created, len(backup.Blocks))
+
+	res, err := patcher.RestoreBackup(ctx, loader, backup, patcher.Options{DryRun: isDryRun, Force: isForce, JournalDir: journalDir, Protected: protected})
+	if err != nil {
+		return err
+	}
+	for _, addr := range res.Written {
+		fmt.Printf("Restored block @ %08X\n", addr)
+	}
 	return nil
 }
@@ -1,35 +1,73 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/device"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patcher"
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
 )
 
+// stringList is a flag that may be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func newStringListFlag(name, usage string) *stringList {
+	l := &stringList{}
+	flag.Var(l, name, usage)
+	return l
+}
+
 var (
-	useEmulator   = flag.Bool("emulator", false, "Use emulator instead of a physical phone.")
-	useFullFlash  = flag.Bool("use_fullflash_not_phone", false, "Use a file with fullflash instead of a physical phone.")
-	usedFFFile    = flag.String("use_fullflash_file_path", "", "Use this file instead of a real phone.")
-	serialPort    = flag.String("serial", "", "Serial port path (like /dev/cu.usbserial-110, or COM2).")
-	serialSpeed   = flag.Int("speed", 115200, "Serial port speed to use.")
-	chaosLoader   = flag.String("loader", "", "Path to Chaos bootloader (.bin file). If not specified, an embedded loader is used.")
-	useRestoreOld = flag.Bool("restore_old_data_from_ff", false, "If true, restore blocks changed by patch -patch_file from the FF backup -flash_file.")
-	readFlash     = flag.Bool("read_flash", false, "Read flash to file.")
-	writeFlash    = flag.Bool("write_flash", false, "Write flash from file.")
-	flashFile     = flag.String("flash_file", "", "Path to a flash file to read from / store to.")
-	flashBaseAddr = flag.Int64("base_addr", 0, "Base address to read from / write to.")
-	flashLength   = flag.Int64("length", 0, "Length to read / to write.")
-	applyPatch    = flag.Bool("apply_patch", false, "Apply patch specified by -patch_file.")
-	revertPatch   = flag.Bool("revert_patch", false, "Revert patch specified by -patch_file.")
-	dryRun        = flag.Bool("dry_run", false, "Only verify if a patch can be applied / reverted, but don't actually write data.")
-	forceAction   = flag.Bool("force", false, "Apply /revert patch even if the old data doesn't match.")
-	patchFile     = flag.String("patch_file", "", "Patch file to apply.")
+	useEmulator    = flag.Bool("emulator", false, "Use emulator instead of a physical phone.")
+	emulatorAddr   = flag.String("emulator_socket", device.DefaultEmulatorSocket, "Where to wait for the emulator: a UNIX socket path, tcp:HOST:PORT, or tcp-dial:HOST:PORT to connect to an emulator listening there.")
+	useFullFlash   = flag.Bool("use_fullflash_not_phone", false, "Use a file with fullflash instead of a physical phone.")
+	usedFFFile     = flag.String("use_fullflash_file_path", "", "Use this file instead of a real phone.")
+	ffGeometry     = flag.String("fullflash_geometry", "", "Flash layout of the fullflash: a model name (like C81), a JSON metadata file or a saved Chaos info reply. If empty, <fullflash>.json is used when present.")
+	serialPort     = flag.String("serial", "", "Serial port path (like /dev/cu.usbserial-110, or COM2).")
+	serialSpeed    = flag.Int("speed", 115200, "Serial port speed to use.")
+	chaosLoader    = flag.String("loader", "", "Path to Chaos bootloader (.bin file). If not specified, an embedded loader is used.")
+	useRestoreOld  = flag.Bool("restore_old_data_from_ff", false, "If true, restore blocks changed by patch -patch_file from the FF backup -flash_file.")
+	readFlash      = flag.Bool("read_flash", false, "Read flash to file.")
+	resumeRead     = flag.Bool("resume", false, "Continue an interrupted -read_flash into the same -flash_file.")
+	writeFlash     = flag.Bool("write_flash", false, "Write flash from file.")
+	flashFile      = flag.String("flash_file", "", "Path to a flash file to read from / store to.")
+	flashBaseAddr  = flag.Int64("base_addr", 0, "Base address to read from / write to.")
+	flashLength    = flag.Int64("length", 0, "Length to read / to write.")
+	patchFiles     = newStringListFlag("patch_file", "Patch file (or patches.kibab.com ID) to apply. Give it several times to apply many patches at once.")
+	applyPatch     = flag.Bool("apply_patch", false, "Apply patch specified by -patch_file.")
+	revertPatch    = flag.Bool("revert_patch", false, "Revert patch specified by -patch_file.")
+	dryRun         = flag.Bool("dry_run", false, "Only verify if a patch can be applied / reverted, but don't actually write data.")
+	forceAction    = flag.Bool("force", false, "Apply /revert patch even if the old data doesn't match.")
+	verifyWrites   = flag.Bool("verify", false, "Read every written block back and compare it with the data that was written.")
+	verifyRetries  = flag.Int("verify_retries", 2, "How many times to rewrite a block that fails verification.")
+	commandDelay   = flag.Duration("command_delay", 0, "Wait this long before sending every command to the phone (like 100ms). May help with flaky USB-serial adapters.")
+	backupDir      = flag.String("backup_dir", ".", "Directory to save original blocks to before applying / reverting a patch.")
+	ledgerDir      = flag.String("ledger_dir", patcher.DefaultLedgerDir(), "Directory with the records of patches applied to every phone. Empty disables recording.")
+	journalDir     = flag.String("journal_dir", patcher.DefaultJournalDir(), "Directory to keep the journal of writes in, so that an interrupted write can be recovered. Empty disables journaling.")
+	recoverWrite   = flag.String("recover", "", "Recover an interrupted write: \"finish\" writes the rest of it, \"rollback\" restores the blocks as they were before.")
+	allowProtected = newStringListFlag("allow_protected", "Allow writing to this protected flash region (boot, eelite, eefull and ffs on C81 and EL71, boot and eeprom on other models, a region from -protected_regions, or all). May be given several times.")
+	protectedFile  = flag.String("protected_regions", "", "JSON file with protected flash regions of phone models, added to the built-in ones.")
+	showStatus     = flag.Bool("status", false, "Check if the patches recorded as applied to this phone are still there.")
+	restoreBackup  = flag.String("restore_backup", "", "Write blocks from this backup archive back to the phone.")
+	captureFile    = flag.String("capture", "", "Record all traffic with the phone or emulator to this file. Please attach it to bug reports.")
+	replayFile     = flag.String("replay", "", "Play back a file recorded with -capture instead of talking to a phone. All the other flags must be the same as when recording.")
 )
 
 func main() {
@@ -40,26 +78,54 @@ func main() {
 
 	flag.Parse()
 
+	// Ctrl-C stops the current operation instead of killing us in the middle of it.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx = pmb887x.WithProgress(ctx, newProgressBar(os.Stdout))
+
 	if *useFullFlash {
 		fullflash := device.NewDeviceFromFullflash(*usedFFFile)
-		chaos = device.NewLoaderForFullflashFile(fullflash)
-		dev = fullflash
-	} else if *useEmulator {
-
-		dev, err = device.NewEmulatorBackend()
-		if err != nil {
-			fmt.Printf("Cannot create new emulator connection: %v\n", err)
-			os.Exit(1)
+		ffLoader := device.NewLoaderForFullflashFile(fullflash)
+		if *ffGeometry != "" {
+			ffInfo, err := device.PhoneInfoFromSpec(*ffGeometry)
+			if err != nil {
+				fmt.Printf("Cannot get fullflash geometry: %v\n", err)
+				os.Exit(1)
+			}
+			ffLoader.SetPhoneInfo(ffInfo)
 		}
+		chaos = ffLoader
+		dev = fullflash
 	} else {
-		if *serialPort == "" {
-			fmt.Println("Must specify a serial port path")
-			os.Exit(1)
+		if *replayFile != "" {
+			dev, err = device.NewReplayBackend(*replayFile)
+			if err != nil {
+				fmt.Printf("Cannot load capture to replay: %v\n", err)
+				os.Exit(1)
+			}
+		} else if *useEmulator {
+			dev, err = device.NewEmulatorBackend(*emulatorAddr)
+			if err != nil {
+				fmt.Printf("Cannot create new emulator connection: %v\n", err)
+				os.Exit(1)
+			}
+		} else {
+			if *serialPort == "" {
+				fmt.Println("Must specify a serial port path")
+				os.Exit(1)
+			}
+			dev, err = device.NewPhone(*serialPort)
+			if err != nil {
+				fmt.Printf("Cannot instantiate new phone connection: %v\n", err)
+				os.Exit(1)
+			}
 		}
-		dev, err = device.NewPhone(*serialPort)
-		if err != nil {
-			fmt.Printf("Cannot instantiate new phone connection: %v\n", err)
-			os.Exit(1)
+
+		if *captureFile != "" {
+			if err := startCapture(dev, *captureFile); err != nil {
+				fmt.Printf("Cannot capture traffic: %v\n", err)
+				os.Exit(1)
+			}
 		}
 
 		var loader []byte
@@ -73,41 +139,67 @@ func main() {
 			loader = pmb887x.ChaosLoaderBin
 		}
 
-		if err = dev.ConnectAndBoot(loader); err != nil {
+		if err = dev.ConnectAndBoot(ctx, loader); err != nil {
 			fmt.Printf("Cannot boot device with Chaos boot: %v", err)
 			os.Exit(1)
 		}
 
 		// Now create a Chaos controller so  that all other operations interact with it
 		// instead of a plain firmware.
-		chaos = pmb887x.ChaosControllerForDevice(dev.PMB())
+		chaosController := pmb887x.ChaosControllerForDevice(dev.PMB())
+		chaosController.SetVerify(*verifyWrites, *verifyRetries)
+		chaosController.SetCommandDelay(*commandDelay)
+		chaos = chaosController
 	}
-	if err = chaos.Activate(); err != nil {
+	if err = chaos.Activate(ctx); err != nil {
 		fmt.Printf("Cannot activate Chaos boot: %v\n", err)
 		os.Exit(1)
 	}
 
 	fmt.Printf("Attempting to change COM speed to %d\n", *serialSpeed)
 	ourSpeedSetter := func() error { return dev.SetSpeed(*serialSpeed) }
-	if err := chaos.SetSpeed(*serialSpeed, ourSpeedSetter); err != nil {
+	if err := chaos.SetSpeed(ctx, *serialSpeed, ourSpeedSetter); err != nil {
 		fmt.Printf("Cannot set comms speed %d with Chaos boot: %v\n", serialSpeed, err)
 		os.Exit(1)
 	}
 
 	var info pmb887x.ChaosPhoneInfo
-	if info, err = chaos.ReadInfo(); err != nil {
+	if info, err = chaos.ReadInfo(ctx); err != nil {
 		fmt.Printf("Cannot read information from Chaos boot: %v\n", err)
 		os.Exit(1)
 	}
 	fmt.Printf("Phone information:\n%s\n", info)
 
+	protected, err := protectedRegions(info)
+	if err != nil {
+		fmt.Printf("Cannot set up protected flash regions: %v\n", err)
+		os.Exit(1)
+	}
+
+	var journal *patcher.Journal
+	if *journalDir != "" {
+		if journal, err = checkJournal(ctx, chaos, info, *journalDir); err != nil {
+			fmt.Printf("Cannot check the journal of interrupted writes: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *recoverWrite != "" {
+		if journal == nil {
+			fmt.Println("No interrupted write to recover.")
+		} else if err := DoRecover(ctx, chaos, journal, *recoverWrite); err != nil {
+			fmt.Printf("Cannot recover the interrupted write: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	beginTime := time.Now()
 
 	if *useRestoreOld {
-		if *flashFile == "" || *patchFile == "" {
-			log.Fatalf("-flash_file and -patch_file must not be empty!")
+		if *flashFile == "" || len(*patchFiles) != 1 {
+			log.Fatalf("-flash_file and exactly one -patch_file must be given!")
 		}
-		if err := RestoreOldDataFromFullflash(chaos, *patchFile, *flashFile); err != nil {
+		if err := RestoreOldDataFromFullflash(ctx, chaos, (*patchFiles)[0], *flashFile, *journalDir, protected); err != nil {
+			explainProtected(err)
 			log.Fatalf("Cannot restore data: %v", err)
 		}
 	}
@@ -126,7 +218,7 @@ func main() {
 			os.Exit(1)
 		}
 		printScaryTimeStats()
-		if err := readFlashToFile(chaos, *flashBaseAddr, *flashLength, *flashFile); err != nil {
+		if err := readFlashToFile(ctx, chaos, info, *flashBaseAddr, *flashLength, *flashFile, *resumeRead); err != nil {
 			fmt.Printf("Cannot read flash from 0x%X len 0x%0X: %v\n", *flashBaseAddr, *flashLength, err)
 			os.Exit(1)
 		}
@@ -138,23 +230,60 @@ func main() {
 			os.Exit(1)
 		}
 		printScaryTimeStats()
-		if err := writeFlashFromFile(chaos, *flashBaseAddr, *flashLength, *flashFile); err != nil {
+		if err := writeFlashFromFile(ctx, chaos, *flashBaseAddr, *flashLength, *flashFile, *journalDir, protected); err != nil {
+			explainProtected(err)
 			fmt.Printf("Cannot write flash to 0x%X len 0x%0X: %v\n", *flashBaseAddr, *flashLength, err)
 			os.Exit(1)
 		}
 	}
 
 	if *applyPatch || *revertPatch {
-		if err := DoApplyPatch(chaos, *patchFile, *revertPatch, *dryRun, *forceAction); err != nil {
-			fmt.Printf("Cannot apply or revert patch %q! Error: %v", filepath.Base(*patchFile), err)
+		if err := DoApplyPatch(ctx, chaos, *patchFiles, *backupDir, *ledgerDir, *journalDir, protected, *revertPatch, *dryRun, *forceAction); err != nil {
+			explainProtected(err)
+			fmt.Printf("Cannot apply or revert %s! Error: %v", patchFiles.String(), err)
+		}
+	}
+
+	if *showStatus {
+		if err := DoStatus(ctx, chaos, info, *ledgerDir); err != nil {
+			fmt.Printf("Cannot check patch status: %v\n", err)
+		}
+	}
+
+	if *restoreBackup != "" {
+		if err := DoRestoreBackup(ctx, chaos, *restoreBackup, *journalDir, protected, *dryRun, *forceAction); err != nil {
+			explainProtected(err)
+			fmt.Printf("Cannot restore backup %q! Error: %v", filepath.Base(*restoreBackup), err)
 		}
 	}
 	elapsed := time.Since(beginTime)
 	fmt.Printf("Operation took %v.\n", elapsed)
+	if replay, ok := dev.(*device.ReplayDevice); ok {
+		if err := replay.Check(); err != nil {
+			fmt.Printf("Replay differs from the capture: %v\n", err)
+		} else {
+			fmt.Println("Replay matches the capture.")
+		}
+	}
 	dev.Disconnect()
 	fmt.Println()
 }
 
+// startCapture makes dev record its traffic to a new file at path.
+func startCapture(dev device.Device, path string) error {
+	cd, ok := dev.(device.CapturingDevice)
+	if !ok {
+		return fmt.Errorf("%s doesn't support capturing", dev.Name())
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	cd.SetCapture(f)
+	log.Printf("Capturing traffic to %q", path)
+	return nil
+}
+
 func printScaryTimeStats() {
 	needTime := *flashLength / int64(*serialSpeed/8)
 	dur, _ := time.ParseDuration(fmt.Sprintf("%ds", needTime))
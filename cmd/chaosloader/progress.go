@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
+)
+
+const (
+	progressBarWidth       = 30
+	progressRedrawInterval = 200 * time.Millisecond
+)
+
+// progressBar draws progress of long operations as a single line in the terminal.
+type progressBar struct {
+	mu       sync.Mutex
+	out      io.Writer
+	lastDraw time.Time
+}
+
+func newProgressBar(out io.Writer) *progressBar {
+	return &progressBar{out: out}
+}
+
+// Report implements pmb887x.ProgressReporter.
+func (b *progressBar) Report(p pmb887x.Progress) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	finished := p.Total > 0 && p.Done >= p.Total
+	now := time.Now()
+	if !finished && now.Sub(b.lastDraw) < progressRedrawInterval {
+		return
+	}
+	b.lastDraw = now
+
+	var line string
+	if p.Total > 0 {
+		filled := int(p.Done * progressBarWidth / p.Total)
+		if filled > progressBarWidth {
+			filled = progressBarWidth
+		}
+		line = fmt.Sprintf("%-10s [%s%s] %3d%% @ 0x%08X", p.Phase, strings.Repeat("#", filled), strings.Repeat(".", progressBarWidth-filled), p.Done*100/p.Total, p.Addr)
+		if eta := p.ETA().Round(time.Second); eta > 0 {
+			line += fmt.Sprintf(" ETA %v", eta)
+		}
+	} else {
+		line = fmt.Sprintf("%-10s %v", p.Phase, time.Since(p.Started).Round(time.Second))
+	}
+	if p.Retries > 0 {
+		line += fmt.Sprintf(" (retry %d)", p.Retries)
+	}
+	// Return to the line start and clear it before drawing.
+	fmt.Fprintf(b.out, "\r%s\033[K", line)
+	if finished {
+		fmt.Fprintln(b.out)
+	}
+}
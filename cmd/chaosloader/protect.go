@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patcher"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
+)
+
+// protectedRegions returns the regions of the phone that are written only if given in -allow_protected.
+func protectedRegions(info pmb887x.ChaosPhoneInfo) ([]patcher.ProtectedRegion, error) {
+	var models map[string][]patcher.ProtectedRegion
+	if *protectedFile != "" {
+		var err error
+		if models, err = patcher.LoadProtectedRegions(*protectedFile); err != nil {
+			return nil, err
+		}
+	}
+	regions := patcher.ProtectedRegions(info, models)
+	for _, r := range regions {
+		log.Printf("Protected flash region %v", r)
+	}
+	return patcher.AllowRegions(regions, *allowProtected)
+}
+
+// explainProtected prints the blocks that were not written because of protection, if that's what err is about.
+func explainProtected(err error) {
+	var protErr *patcher.ProtectedError
+	if !errors.As(err, &protErr) {
+		return
+	}
+	for _, h := range protErr.Hits {
+		fmt.Printf("Block @ %08X is in protected region %q\n", h.Block, h.Region)
+	}
+	fmt.Println("Nothing was written. Give -allow_protected=<region> if you really mean to write there.")
+}
@@ -1,52 +1,242 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
 	"os"
 
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/device"
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
 )
 
-func readFlashToFile(loader pmb887x.ChaosLoaderInterface, baseAddr, size int64, filePath string) error {
-	ff, err := os.Create(filePath)
+const (
+	defaultReadSize   = 65536 // 64K
+	checkpointFileExt = ".checkpoint"
+)
+
+// flashRange is a half-open range of flash addresses [Start, End).
+type flashRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// readCheckpoint is stored next to a flash dump while it is being read,
+// so that an interrupted dump can be resumed.
+type readCheckpoint struct {
+	BaseAddr  int64        `json:"base_addr"`
+	Size      int64        `json:"size"`
+	Completed []flashRange `json:"completed"`
+}
+
+// done returns how many bytes from the beginning of the dump are already in the file.
+func (c *readCheckpoint) done() int64 {
+	if len(c.Completed) == 0 || c.Completed[0].Start != c.BaseAddr {
+		return 0
+	}
+	return c.Completed[0].End - c.BaseAddr
+}
+
+// markDone records that the range [start, end) is in the file.
+func (c *readCheckpoint) markDone(start, end int64) {
+	if n := len(c.Completed); n > 0 && c.Completed[n-1].End == start {
+		c.Completed[n-1].End = end
+		return
+	}
+	c.Completed = append(c.Completed, flashRange{Start: start, End: end})
+}
+
+// truncate forgets everything after the first size bytes of the dump.
+func (c *readCheckpoint) truncate(size int64) {
+	c.Completed = nil
+	if size > 0 {
+		c.markDone(c.BaseAddr, c.BaseAddr+size)
+	}
+}
+
+func checkpointPath(filePath string) string {
+	return filePath + checkpointFileExt
+}
+
+func loadCheckpoint(filePath string) (*readCheckpoint, error) {
+	data, err := os.ReadFile(checkpointPath(filePath))
 	if err != nil {
-		return fmt.Errorf("cannot open file to store flashdump: %v", err)
+		return nil, err
 	}
-	defer ff.Close()
+	c := &readCheckpoint{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("cannot parse checkpoint: %v", err)
+	}
+	return c, nil
+}
+
+func (c *readCheckpoint) save(filePath string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that a crash never leaves a broken checkpoint.
+	tmpPath := checkpointPath(filePath) + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, checkpointPath(filePath))
+}
 
+// readWithRetries reads buf from flash at addr, retrying on errors.
+func readWithRetries(ctx context.Context, loader pmb887x.ChaosLoaderInterface, addr int64, buf []byte) error {
 	maxRetries := 3
-	defaultReadSize := 65536 // 64K
-	stillNeedToRead := size
-	errCount := 0
+	attempt := 0
+	retryCtx := pmb887x.WithProgress(ctx, pmb887x.ProgressFunc(func(p pmb887x.Progress) {
+		p.Retries = attempt
+		pmb887x.ReportProgress(ctx, p)
+	}))
+	for retries := maxRetries; retries > 0; retries-- {
+		attempt = maxRetries - retries
+		if err := loader.ReadFlash(retryCtx, addr, buf); err != nil {
+			if ctx.Err() != nil {
+				// Cancelled, no point in retrying.
+				fmt.Println()
+				return err
+			}
+			fmt.Printf("\n\tError reading flash @ %08X: %v. Retries left: %d\n", addr, err, retries)
+			continue
+		}
+		return nil
+	}
+	fmt.Printf("\n\tCannot read block @ %08X after retries!\n", addr)
+	return fmt.Errorf("cannot read block @ %08X after retries", addr)
+}
+
+// resumeDump opens an interrupted dump for appending.
+// The last chunk in the file is read again from the phone and compared,
+// if it doesn't match, it is dropped and read again.
+func resumeDump(ctx context.Context, loader pmb887x.ChaosLoaderInterface, baseAddr, size int64, filePath string) (*os.File, *readCheckpoint, error) {
+	cp, err := loadCheckpoint(filePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot load checkpoint to resume from: %v", err)
+	}
+	if cp.BaseAddr != baseAddr || cp.Size != size {
+		return nil, nil, fmt.Errorf("checkpoint is for 0x%X len 0x%X, not for 0x%X len 0x%X", cp.BaseAddr, cp.Size, baseAddr, size)
+	}
+	ff, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open file to resume flashdump: %v", err)
+	}
+
+	done := cp.done()
+	if done > 0 {
+		lastLen := done % defaultReadSize
+		if lastLen == 0 {
+			lastLen = defaultReadSize
+		}
+		lastOff := done - lastLen
+		fromFile := make([]byte, lastLen)
+		if _, err := ff.ReadAt(fromFile, lastOff); err != nil {
+			ff.Close()
+			return nil, nil, fmt.Errorf("cannot read the last chunk from the file: %v", err)
+		}
+		fromPhone := make([]byte, lastLen)
+		if err := readWithRetries(ctx, loader, baseAddr+lastOff, fromPhone); err != nil {
+			ff.Close()
+			return nil, nil, err
+		}
+		if bytes.Equal(fromFile, fromPhone) {
+			fmt.Println("last chunk verified")
+		} else {
+			fmt.Println("last chunk differs, reading it again")
+			done = lastOff
+		}
+	}
+	cp.truncate(done)
+	if err := ff.Truncate(done); err != nil {
+		ff.Close()
+		return nil, nil, fmt.Errorf("cannot truncate flashdump: %v", err)
+	}
+	if _, err := ff.Seek(done, io.SeekStart); err != nil {
+		ff.Close()
+		return nil, nil, fmt.Errorf("cannot seek in flashdump: %v", err)
+	}
+	fmt.Printf("Resuming flash dump at 0x%08X, 0x%X of 0x%X bytes already done\n", baseAddr+done, done, size)
+	return ff, cp, nil
+}
+
+// saveDumpMetadata stores the phone info next to a dump of the whole flash,
+// so that the dump can later be used with the same flash layout as the phone.
+func saveDumpMetadata(info pmb887x.ChaosPhoneInfo, baseAddr, size int64, filePath string) error {
+	if baseAddr != info.BlockMap.BaseAddr() || size != info.BlockMap.TotalSize() {
+		fmt.Println("Not a full flash dump, phone info is not saved next to it")
+		return nil
+	}
+	mdPath := device.MetadataPath(filePath)
+	if err := device.NewFullflashMetadata(info).Save(mdPath); err != nil {
+		return fmt.Errorf("cannot save phone info: %v", err)
+	}
+	fmt.Printf("Phone info saved to %s\n", mdPath)
+	return nil
+}
+
+func readFlashToFile(ctx context.Context, loader pmb887x.ChaosLoaderInterface, info pmb887x.ChaosPhoneInfo, baseAddr, size int64, filePath string, resume bool) error {
+	var ff *os.File
+	var cp *readCheckpoint
+	var err error
+	if resume {
+		if ff, cp, err = resumeDump(ctx, loader, baseAddr, size, filePath); err != nil {
+			return err
+		}
+	} else {
+		if _, err := os.Stat(checkpointPath(filePath)); err == nil {
+			fmt.Printf("Found an interrupted dump of %s, starting from scratch. Use -resume to continue it instead.\n", filePath)
+		}
+		if ff, err = os.Create(filePath); err != nil {
+			return fmt.Errorf("cannot open file to store flashdump: %v", err)
+		}
+		// Phone info of an older dump doesn't belong to the new one until it's complete.
+		if err := os.Remove(device.MetadataPath(filePath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("cannot remove old phone info: %v", err)
+		}
+		cp = &readCheckpoint{BaseAddr: baseAddr, Size: size}
+	}
+	defer ff.Close()
+
+	dumpAddr := baseAddr
+	done := cp.done()
+	baseAddr += done
+	stillNeedToRead := size - done
+	op := pmb887x.StartOperation(ctx, size)
+	op.Advance(done)
 
-	totalRead := int64(0)
 	for stillNeedToRead > 0 {
 		readSize := int64(math.Min(float64(stillNeedToRead), float64(defaultReadSize)))
 		buf := make([]byte, readSize)
-		retries := maxRetries
-		for ; retries > 0; retries-- {
-			fmt.Printf("[Retry %d] Transfering %d bytes from addr %X...", maxRetries-retries, readSize, baseAddr)
-			if err := loader.ReadFlash(int64(baseAddr), buf); err != nil {
-				fmt.Printf("\n\tError reading flash @ %08X: %v. Retries left: %d\n", baseAddr, err, retries)
-				errCount++
-				continue
-			}
-			break
-		}
-		if retries == 0 {
-			fmt.Printf("\n\tCannot read block @ %08X after retries!\n", baseAddr)
-			return fmt.Errorf("cannot read block @ %08X after retries", baseAddr)
+		if err := readWithRetries(op.Step(ctx), loader, baseAddr, buf); err != nil {
+			return err
 		}
 
 		n, err := ff.Write(buf)
 		if n != len(buf) {
 			return fmt.Errorf("cannot write block @ %08X to the fullflash file: %v", baseAddr, err)
 		}
-		fmt.Println("ok")
+		if err := ff.Sync(); err != nil {
+			return fmt.Errorf("cannot sync the fullflash file: %v", err)
+		}
+		cp.markDone(baseAddr, baseAddr+readSize)
+		if err := cp.save(filePath); err != nil {
+			return fmt.Errorf("cannot save checkpoint: %v", err)
+		}
+		op.Advance(readSize)
+		op.Report(pmb887x.PhaseReading, baseAddr+readSize, 0)
 		baseAddr += int64(readSize)
 		stillNeedToRead -= int64(readSize)
-		totalRead += int64(readSize)
 	}
-	return nil
+
+	// The dump is complete, the checkpoint is not needed anymore.
+	if err := os.Remove(checkpointPath(filePath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot remove checkpoint: %v", err)
+	}
+	return saveDumpMetadata(info, dumpAddr, size, filePath)
 }
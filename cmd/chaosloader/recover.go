@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patcher"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
+)
+
+// checkJournal warns about a write to this phone that was interrupted. It returns the journal, if any.
+func checkJournal(ctx context.Context, loader pmb887x.ChaosLoaderInterface, info pmb887x.ChaosPhoneInfo, journalDir string) (*patcher.Journal, error) {
+	j, err := patcher.OpenJournal(journalDir, info)
+	if err != nil || j == nil {
+		return nil, err
+	}
+	fmt.Printf("WARNING: a write started %v was interrupted, %d of %d blocks were written.\n",
+		j.Created.Format("2006-01-02 15:04"), j.Done(), len(j.Blocks))
+	states, err := j.Inspect(ctx, loader)
+	if err != nil {
+		return j, err
+	}
+	for i, b := range j.Blocks {
+		fmt.Printf("Block @ %08X is %v\n", b.Addr, states[i])
+	}
+	fmt.Println("Run again with -recover=finish to complete it or -recover=rollback to undo it.")
+	return j, nil
+}
+
+// DoRecover finishes or rolls back the write recorded in the journal.
+func DoRecover(ctx context.Context, loader pmb887x.ChaosLoaderInterface, j *patcher.Journal, mode string) error {
+	var rollback bool
+	done := "finished"
+	switch mode {
+	case "finish":
+	case "rollback":
+		rollback, done = true, "rolled back"
+	default:
+		return fmt.Errorf("unknown -recover mode %q, must be finish or rollback", mode)
+	}
+	res, err := j.Recover(ctx, loader, rollback)
+	if err != nil {
+		return err
+	}
+	for _, addr := range res.Written {
+		fmt.Printf("Written block @ %08X\n", addr)
+	}
+	fmt.Printf("Interrupted write is %s, journal %s removed.\n", done, j.Path())
+	return nil
+}
@@ -1,76 +1,56 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"strconv"
+	"time"
 
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/device"
-	"github.com/siemens-mobile-hacks/siepatcher/pkg/patcheskibabcom"
-	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patcher"
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
 )
 
-func RestoreOldDataFromFullflash(loader pmb887x.ChaosLoaderInterface, patchFile, fullflashPath string) error {
-	var pr *patchreader.PatchReader
-	// Load a patch.
-	patchID, err := strconv.ParseInt(patchFile, 10, 64)
+// fullflashReader reads flash blocks from a fullflash dump with flash starting at baseAddr.
+type fullflashReader struct {
+	ff       *device.FullflashFile
+	baseAddr int64
+}
+
+func (r fullflashReader) ReadFlash(_ context.Context, addr int64, buf []byte) error {
+	data, err := r.ff.ReadRegion(addr-r.baseAddr, int64(len(buf)))
 	if err != nil {
-		pr, err = patchreader.FromFile(patchFile)
-	} else {
-		patchText, err := patcheskibabcom.PatchByID(int(patchID))
-		if err != nil {
-			return err
-		}
-		if pr, err = patchreader.FromString(patchText); err != nil {
-			return err
-		}
+		return err
 	}
+	copy(buf, data)
+	return nil
+}
+
+func RestoreOldDataFromFullflash(ctx context.Context, loader pmb887x.ChaosLoaderInterface, patchFile, fullflashPath, journalDir string, protected []patcher.ProtectedRegion) error {
+	pr, err := patcher.Load(patchFile)
 	if err != nil {
-		return fmt.Errorf("cannot load patch: %v", err)
+		return err
 	}
 	log.Printf("Loaded and parsed the patch successfully")
 
 	ff := device.NewDeviceFromFullflash(fullflashPath)
-	if err := ff.ConnectAndBoot(nil); err != nil {
+	if err := ff.ConnectAndBoot(ctx, nil); err != nil {
 		return fmt.Errorf("cannot load fullflash: %v", err)
 	}
+	defer ff.Disconnect()
 
-	flashInfo, err := loader.ReadInfo()
+	flashInfo, err := loader.ReadInfo(ctx)
 	if err != nil {
 		return err
 	}
-	blockMapper := flashInfo.BlockMap
-	var blockCache map[int64][]byte = map[int64][]byte{}
-	// Figure out what blocks need to be modified.
-	patchChunks := pr.Chunks()
-
-	for _, chunk := range patchChunks {
-		for addr := chunk.BaseAddr; addr < chunk.EndAddr(); addr++ {
-			baseAddr, size, err := blockMapper.ParamsForAddr(addr + blockMapper.BaseAddr())
-			if err != nil {
-				return fmt.Errorf("error when mapping patch chunks to blocks: %v", err)
-			}
-			if _, ok := blockCache[baseAddr]; ok {
-				// This block is cached.
-				continue
-			}
-			fmt.Printf("Need to request block @ %X size %X\n", baseAddr, size)
-			blockCache[baseAddr] = make([]byte, size)
-
-			blockCache[baseAddr], err = ff.ReadRegion(int64(baseAddr-blockMapper.BaseAddr()), size)
-			if err != nil {
-				return fmt.Errorf("cannot read block @ %08X size %08X from fullflash: %v", baseAddr, size, err)
-			}
-		}
+	begin := time.Now()
+	res, err := patcher.RestoreFromFlash(ctx, loader, pr, fullflashReader{ff: ff, baseAddr: flashInfo.BlockMap.BaseAddr()}, patcher.Options{JournalDir: journalDir, Protected: protected})
+	if err != nil {
+		return err
 	}
-
-	for addr, block := range blockCache {
-		fmt.Printf("Writing block @ %08X len %08X\n", addr, len(block))
-		if err := loader.WriteFlash(addr, block); err != nil {
-			return fmt.Errorf("error writing block: %v", err)
-		}
+	for _, addr := range res.Written {
+		fmt.Printf("Written block @ %08X\n", addr)
 	}
-
+	reportSkipped(res, time.Since(begin))
 	return nil
 }
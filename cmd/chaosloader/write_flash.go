@@ -1,17 +1,76 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patcher"
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
 )
 
-func writeFlashFromFile(loader pmb887x.ChaosLoaderInterface, baseAddr, size int64, filePath string) error {
+// writeFlashFromFile writes size bytes of the file to flash at baseAddr.
+// The range may start and end anywhere: erase blocks covered only partly are read,
+// changed and written whole. Blocks that already have the same data are not written.
+func writeFlashFromFile(ctx context.Context, loader pmb887x.ChaosLoaderInterface, baseAddr, size int64, filePath, journalDir string, protected []patcher.ProtectedRegion) error {
 	buf, err := os.ReadFile(filePath)
 	if err != nil {
 		return fmt.Errorf("cannot open file to read flashdump: %v", err)
 	}
+	if int64(len(buf)) < size {
+		return fmt.Errorf("%s has only 0x%X bytes", filePath, len(buf))
+	}
+
+	fmt.Println("Comparing blocks with the phone...")
+	plan, err := patcher.PrepareImage(ctx, loader, baseAddr, buf[:size])
+	if err != nil {
+		return err
+	}
+	for _, block := range plan.Blocks {
+		if block.Addr < baseAddr || block.Addr+int64(len(block.Data)) > baseAddr+size {
+			fmt.Printf("Block @ %08X is covered only partly, the rest of it is kept as is\n", block.Addr)
+		}
+	}
+	begin := time.Now()
+	res, err := patcher.Execute(ctx, loader, plan, patcher.Options{JournalDir: journalDir, Protected: protected})
+	if err != nil {
+		return err
+	}
+	reportSkipped(res, time.Since(begin))
+	return nil
+}
 
-	return loader.WriteFlash(baseAddr, buf[:size])
+// reportSkipped tells how many blocks of res didn't have to be written and about how much time it saved.
+func reportSkipped(res *patcher.Result, elapsed time.Duration) {
+	var written, skipped int64
+	for _, block := range res.Plan.Blocks {
+		if containsAddr(res.Written, block.Addr) {
+			written += int64(len(block.Data))
+		} else if containsAddr(res.Skipped, block.Addr) {
+			skipped += int64(len(block.Data))
+		}
+	}
+	fmt.Printf("Written %d blocks (0x%X bytes), skipped %d identical blocks (0x%X bytes).\n",
+		len(res.Written), written, len(res.Skipped), skipped)
+	if skipped == 0 {
+		return
+	}
+	var saved time.Duration
+	if written > 0 {
+		saved = time.Duration(float64(elapsed) * float64(skipped) / float64(written))
+	} else {
+		// Nothing was written, so guess by the port speed like printScaryTimeStats does.
+		saved = time.Duration(skipped/int64(*serialSpeed/8)) * time.Second
+	}
+	fmt.Printf("Skipping them saved about %v.\n", saved.Round(time.Second))
+}
+
+func containsAddr(addrs []int64, addr int64) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
 }
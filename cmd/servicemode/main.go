@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/device"
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
@@ -11,7 +13,9 @@ import (
 
 var (
 	useEmulator   = flag.Bool("emulator", false, "Use emulator instead of a physical phone.")
+	emulatorAddr  = flag.String("emulator_socket", device.DefaultEmulatorSocket, "Where to wait for the emulator: a UNIX socket path, tcp:HOST:PORT, or tcp-dial:HOST:PORT to connect to an emulator listening there.")
 	serialPort    = flag.String("serial", "", "Serial port path (like /dev/cu.usbserial-110, or COM2).")
+	captureFile   = flag.String("capture", "", "Record all traffic with the phone or emulator to this file.")
 	useNormalMode = flag.Bool("normal_mode", false, "Boot into Normal Mode instead of Service Mode.")
 )
 
@@ -22,9 +26,12 @@ func main() {
 
 	flag.Parse()
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	if *useEmulator {
 
-		dev, err = device.NewEmulatorBackend()
+		dev, err = device.NewEmulatorBackend(*emulatorAddr)
 		if err != nil {
 			fmt.Printf("Cannot create new emulator connection: %v", err)
 			os.Exit(1)
@@ -41,11 +48,26 @@ func main() {
 		}
 	}
 
+	if *captureFile != "" {
+		cd, ok := dev.(device.CapturingDevice)
+		if !ok {
+			fmt.Printf("%s doesn't support capturing", dev.Name())
+			os.Exit(1)
+		}
+		f, err := os.Create(*captureFile)
+		if err != nil {
+			fmt.Printf("Cannot create capture file: %v", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		cd.SetCapture(f)
+	}
+
 	loader := pmb887x.ServiceModeBoot
 	if *useNormalMode {
 		loader = pmb887x.NormalModeBoot
 	}
-	if err = dev.ConnectAndBoot(loader); err != nil {
+	if err = dev.ConnectAndBoot(ctx, loader); err != nil {
 		fmt.Printf("Cannot boot device into service mode: %v", err)
 		os.Exit(1)
 	}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/device"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patcher"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+)
+
+// subcommands can be run from the command line, like "siepatcher diff ...", without the GUI.
+var subcommands = map[string]func(args []string) error{
+	"diff":    runDiff,
+	"patches": runPatches,
+}
+
+// runSubcommand runs a command-line subcommand. It returns false if there is no such
+// subcommand, e.g. the arguments are for the GUI toolkit.
+func runSubcommand(name string, args []string) bool {
+	run, ok := subcommands[name]
+	if !ok {
+		return false
+	}
+	if err := run(args); err != nil {
+		fmt.Printf("siepatcher %s: %v\n", name, err)
+		os.Exit(1)
+	}
+	return true
+}
+
+// runDiff generates a VKP patch from two fullflash dumps.
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	origPath := fs.String("orig", "", "Path to the original fullflash.")
+	modPath := fs.String("modified", "", "Path to the modified fullflash.")
+	outPath := fs.String("out", "", "Path to the VKP file to create. If empty, the patch is printed.")
+	mergeGap := fs.Int64("merge_gap", 8, "Changes separated by at most this many unchanged bytes go into one chunk.")
+	baseOffset := fs.Int64("base_offset", 0, "Offset of the dumps from the beginning of flash; added to all patch addresses.")
+	lineWidth := fs.Int("line_width", patchreader.DefaultBytesPerLine, "Maximum number of bytes on one VKP line.")
+	fs.Parse(args)
+
+	if *origPath == "" || *modPath == "" {
+		return fmt.Errorf("-orig and -modified must be set")
+	}
+
+	orig := device.NewDeviceFromFullflash(*origPath)
+	if err := orig.ConnectAndBoot(context.Background(), nil); err != nil {
+		return fmt.Errorf("cannot open original fullflash: %v", err)
+	}
+	defer orig.Disconnect()
+	modified := device.NewDeviceFromFullflash(*modPath)
+	if err := modified.ConnectAndBoot(context.Background(), nil); err != nil {
+		return fmt.Errorf("cannot open modified fullflash: %v", err)
+	}
+	defer modified.Disconnect()
+	if orig.Size() != modified.Size() {
+		return fmt.Errorf("fullflash sizes differ: %d and %d bytes", orig.Size(), modified.Size())
+	}
+
+	chunks, err := patcher.Diff(orig, modified, orig.Size(), patcher.DiffOptions{MergeGap: *mergeGap, BaseOffset: *baseOffset})
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if *outPath != "" {
+		if out, err = os.Create(*outPath); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	header := fmt.Sprintf("Generated by siepatcher diff\nOriginal: %s\nModified: %s", *origPath, *modPath)
+	if err := patchreader.WriteVKP(out, chunks, patchreader.WriteOptions{BytesPerLine: *lineWidth, Header: header}); err != nil {
+		return err
+	}
+	if *outPath != "" {
+		fmt.Printf("%d chunks written to %s\n", len(chunks), *outPath)
+	}
+	return nil
+}
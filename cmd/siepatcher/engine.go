@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"sync"
 
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/device"
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
@@ -10,7 +12,6 @@ import (
 
 var dev device.Device
 var chaos pmb887x.ChaosLoaderInterface
-var err error
 
 func errReply(errstr error, reply chan<- PatcherReply) {
 	log.Print(errstr)
@@ -30,65 +31,159 @@ func reportProgress(msg string, reply chan<- PatcherReply) {
 	reply <- rep
 }
 
+// PatchEngine runs commands from the UI one at a time and reports back.
+// A running command is stopped by CancelCommand.
 func PatchEngine(cmd <-chan PatcherCommand, reply chan<- PatcherReply) {
+	var mu sync.Mutex
+	var cancelRunning context.CancelFunc
+	busy := make(chan struct{}, 1)
+
 	for ev := range cmd {
 		log.Printf("PatchEngine: Got a command %v", ev)
-		switch ev.EventType {
-		case ConnectTarget:
-			if ev.ConnectInfo.SerialPath != "" {
-				dev, err = device.NewPhone(ev.ConnectInfo.SerialPath)
-				if err != nil {
-					errReply(fmt.Errorf("cannot instantiate new phone connection: %v", err), reply)
-					dev.Disconnect()
-					continue
-				}
-
-				reportProgress("Press RED button", reply)
-
-				if err = dev.ConnectAndBoot(pmb887x.ChaosLoaderBin); err != nil {
-					errReply(fmt.Errorf("cannot boot device with Chaos boot: %v", err), reply)
-					dev.Disconnect()
-					continue
-				}
-
-				// Now create a Chaos controller so  that all other operations interact with it
-				// instead of a plain firmware.
-				chaos = pmb887x.ChaosControllerForDevice(dev.PMB())
-			} else if ev.ConnectInfo.EmuSocketPath != "" {
-				errReply(fmt.Errorf("not implemented"), reply)
-				continue
-			} else if ev.ConnectInfo.FFPath != "" {
-				errReply(fmt.Errorf("not implemented"), reply)
-				continue
+		if ev.EventType == CancelCommand {
+			mu.Lock()
+			if cancelRunning != nil {
+				cancelRunning()
 			}
+			mu.Unlock()
+			continue
+		}
 
-			if err = chaos.Activate(); err != nil {
-				errReply(fmt.Errorf("cannot activate Chaos boot"), reply)
-				dev.Disconnect()
-				continue
-			}
+		select {
+		case busy <- struct{}{}:
+		default:
+			errReply(fmt.Errorf("another command is still running"), reply)
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		mu.Lock()
+		cancelRunning = cancel
+		mu.Unlock()
+		go func(ev PatcherCommand) {
+			defer func() {
+				mu.Lock()
+				cancelRunning = nil
+				mu.Unlock()
+				cancel()
+				<-busy
+			}()
+			runCommand(ctx, ev, reply)
+		}(ev)
+	}
+}
 
-			// fmt.Printf("Attempting to change COM speed to %d\n", *serialSpeed)
-			// ourSpeedSetter := func() error { return dev.SetSpeed(*serialSpeed) }
-			// if err := chaos.SetSpeed(*serialSpeed, ourSpeedSetter); err != nil {
-			// 	fmt.Printf("Cannot set comms speed %d with Chaos boot: %v\n", serialSpeed, err)
-			// 	os.Exit(1)
-			// }
-
-			var info pmb887x.ChaosPhoneInfo
-			if info, err = chaos.ReadInfo(); err != nil {
-				errReply(fmt.Errorf("cannot read information from Chaos boot: %v", err), reply)
-				dev.Disconnect()
-				continue
-			}
+func runCommand(ctx context.Context, ev PatcherCommand, reply chan<- PatcherReply) {
+	// Feed progress of long operations to the status bar.
+	ctx = pmb887x.WithProgress(ctx, pmb887x.ProgressFunc(func(p pmb887x.Progress) {
+		reply <- PatcherReply{
+			EventType:     CmdProgress,
+			ProgressDescr: p.String(),
+			Progress:      p,
+		}
+	}))
+	switch ev.EventType {
+	case ConnectTarget:
+		connectTarget(ctx, ev, reply)
+	case LoadPatch:
+		loadPatch(ev, reply)
+	case CheckPatch:
+		checkPatch(ctx, ev, reply)
+	case ApplyPatch:
+		applyPatch(ctx, ev, reply)
+	case RecoverWrite:
+		recoverWrite(ctx, ev, reply)
+	}
+}
 
-			rep := PatcherReply{
-				EventType: TargetInfo,
-				DeviceInfo: struct{ PhoneInfo pmb887x.ChaosPhoneInfo }{
-					PhoneInfo: info,
-				},
-			}
+func connectTarget(ctx context.Context, ev PatcherCommand, reply chan<- PatcherReply) {
+	if dev != nil {
+		// Forget the previous target.
+		dev.Disconnect()
+		dev, chaos, journal = nil, nil, nil
+	}
+
+	// The target is only made current when it's fully connected,
+	// so that a failed connection doesn't leave a half-open one behind.
+	var target device.Device
+	var loader pmb887x.ChaosLoaderInterface
+	var err error
+	if ev.ConnectInfo.SerialPath != "" {
+		target, err = device.NewPhone(ev.ConnectInfo.SerialPath)
+		if err != nil {
+			errReply(fmt.Errorf("cannot instantiate new phone connection: %v", err), reply)
+			return
+		}
+
+		reportProgress("Press RED button", reply)
+
+		if err = target.ConnectAndBoot(ctx, pmb887x.ChaosLoaderBin); err != nil {
+			errReply(fmt.Errorf("cannot boot device with Chaos boot: %v", err), reply)
+			target.Disconnect()
+			return
+		}
+
+		// Now create a Chaos controller so  that all other operations interact with it
+		// instead of a plain firmware.
+		loader = pmb887x.ChaosControllerForDevice(target.PMB())
+	} else if ev.ConnectInfo.EmuSocketPath != "" {
+		target, err = device.NewEmulatorBackend(ev.ConnectInfo.EmuSocketPath)
+		if err != nil {
+			errReply(fmt.Errorf("cannot create new emulator connection: %v", err), reply)
+			return
+		}
+
+		reportProgress(fmt.Sprintf("Waiting for emulator on %s", ev.ConnectInfo.EmuSocketPath), reply)
+
+		if err = target.ConnectAndBoot(ctx, pmb887x.ChaosLoaderBin); err != nil {
+			errReply(fmt.Errorf("cannot boot emulator with Chaos boot: %v", err), reply)
+			target.Disconnect()
+			return
+		}
+		loader = pmb887x.ChaosControllerForDevice(target.PMB())
+	} else if ev.ConnectInfo.FFPath != "" {
+		fullflash := device.NewDeviceFromFullflash(ev.ConnectInfo.FFPath)
+		// Activate below opens the file, the flash layout is taken from
+		// the metadata next to it, if there is one.
+		loader = device.NewLoaderForFullflashFile(fullflash)
+		target = fullflash
+	} else {
+		errReply(fmt.Errorf("no target selected"), reply)
+		return
+	}
+
+	if err = loader.Activate(ctx); err != nil {
+		errReply(fmt.Errorf("cannot activate Chaos boot: %v", err), reply)
+		target.Disconnect()
+		return
+	}
+
+	// fmt.Printf("Attempting to change COM speed to %d\n", *serialSpeed)
+	// ourSpeedSetter := func() error { return dev.SetSpeed(*serialSpeed) }
+	// if err := chaos.SetSpeed(ctx, *serialSpeed, ourSpeedSetter); err != nil {
+	// 	fmt.Printf("Cannot set comms speed %d with Chaos boot: %v\n", serialSpeed, err)
+	// 	os.Exit(1)
+	// }
+
+	info, err := loader.ReadInfo(ctx)
+	if err != nil {
+		errReply(fmt.Errorf("cannot read information from Chaos boot: %v", err), reply)
+		target.Disconnect()
+		return
+	}
+	dev, chaos = target, loader
+
+	rep := PatcherReply{
+		EventType: TargetInfo,
+		DeviceInfo: struct{ PhoneInfo pmb887x.ChaosPhoneInfo }{
+			PhoneInfo: info,
+		},
+	}
+	if ev.ConnectInfo.JournalDir != "" {
+		if rep.JournalDescr, err = checkJournal(ctx, info, ev.ConnectInfo.JournalDir); err != nil {
 			reply <- rep
+			errReply(fmt.Errorf("cannot check for an interrupted write: %v", err), reply)
+			return
 		}
 	}
+	reply <- rep
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patcher"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
+)
+
+// The interrupted write found when connecting to the target, RecoverWrite works with it.
+var journal *patcher.Journal
+
+// checkJournal looks for an interrupted write to the connected target and describes it.
+func checkJournal(ctx context.Context, info pmb887x.ChaosPhoneInfo, journalDir string) (string, error) {
+	j, err := patcher.OpenJournal(journalDir, info)
+	if err != nil || j == nil {
+		return "", err
+	}
+	states, err := j.Inspect(ctx, chaos)
+	if err != nil {
+		return "", err
+	}
+	journal = j
+	descr := fmt.Sprintf("A write started %v was interrupted, %d of %d blocks were written.",
+		j.Created.Format("2006-01-02 15:04"), j.Done(), len(j.Blocks))
+	for i, b := range j.Blocks {
+		descr += fmt.Sprintf("\nBlock @ %08X is %v", b.Addr, states[i])
+	}
+	return descr, nil
+}
+
+func recoverWrite(ctx context.Context, ev PatcherCommand, reply chan<- PatcherReply) {
+	if journal == nil {
+		errReply(fmt.Errorf("there is no interrupted write to recover"), reply)
+		return
+	}
+	res, err := journal.Recover(ctx, chaos, ev.PatchInfo.Revert)
+	if err != nil {
+		errReply(fmt.Errorf("cannot recover the interrupted write: %v", err), reply)
+		return
+	}
+	journal = nil
+	rep := PatcherReply{EventType: WriteRecovered}
+	rep.PatchStatus.Revert = ev.PatchInfo.Revert
+	rep.PatchStatus.Written = len(res.Written)
+	reply <- rep
+}
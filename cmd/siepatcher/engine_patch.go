@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patcher"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+)
+
+// The patch loaded with LoadPatch, all other patch commands work with it.
+var patch *patchreader.PatchReader
+
+func loadPatch(ev PatcherCommand, reply chan<- PatcherReply) {
+	pr, err := patcher.Load(ev.PatchInfo.Source)
+	if err != nil {
+		errReply(fmt.Errorf("cannot load patch %q: %v", ev.PatchInfo.Source, err), reply)
+		return
+	}
+	patch = pr
+
+	rep := PatcherReply{EventType: PatchLoaded}
+	for _, chunk := range pr.Chunks() {
+		rep.PatchStatus.Chunks = append(rep.PatchStatus.Chunks, patcher.ChunkStatus{Chunk: chunk})
+	}
+	reply <- rep
+}
+
+// preparePatch reads the blocks touched by the loaded patch from the target.
+func preparePatch(ctx context.Context, ev PatcherCommand) (*patcher.Plan, error) {
+	if patch == nil {
+		return nil, fmt.Errorf("load a patch first")
+	}
+	if chaos == nil {
+		return nil, fmt.Errorf("connect to a target first")
+	}
+	return patcher.Prepare(ctx, chaos, patch, ev.PatchInfo.Revert)
+}
+
+func checkPatch(ctx context.Context, ev PatcherCommand, reply chan<- PatcherReply) {
+	plan, err := preparePatch(ctx, ev)
+	if err != nil {
+		errReply(fmt.Errorf("cannot check patch: %v", err), reply)
+		return
+	}
+	rep := PatcherReply{EventType: PatchChecked}
+	rep.PatchStatus.Chunks = plan.ChunkStatuses(patch)
+	rep.PatchStatus.Checked = true
+	rep.PatchStatus.Revert = ev.PatchInfo.Revert
+	rep.PatchStatus.CanApply = plan.CanApply()
+	reply <- rep
+}
+
+func applyPatch(ctx context.Context, ev PatcherCommand, reply chan<- PatcherReply) {
+	plan, err := preparePatch(ctx, ev)
+	if err != nil {
+		errReply(fmt.Errorf("cannot apply patch: %v", err), reply)
+		return
+	}
+	rep := PatcherReply{EventType: PatchApplied}
+	rep.PatchStatus.Chunks = plan.ChunkStatuses(patch)
+	rep.PatchStatus.Checked = true
+	rep.PatchStatus.Revert = ev.PatchInfo.Revert
+	rep.PatchStatus.CanApply = plan.CanApply()
+	if !plan.CanApply() && !ev.PatchInfo.Force {
+		errReply(fmt.Errorf("%v; check \"Write over chunks that don't match the flash\" when applying to write it anyway", &patcher.MismatchError{Mismatches: plan.Mismatches}), reply)
+		return
+	}
+
+	// There is no way to allow writing them from the GUI, chaosloader -allow_protected does it.
+	protected := patcher.ProtectedRegions(plan.Info, nil)
+	if err := plan.CheckProtected(protected); err != nil {
+		errReply(fmt.Errorf("%v; nothing was written, chaosloader -allow_protected can write there", err), reply)
+		return
+	}
+
+	if err := os.MkdirAll(ev.PatchInfo.BackupDir, 0755); err != nil {
+		errReply(fmt.Errorf("cannot create backup directory: %v", err), reply)
+		return
+	}
+	backupPath, err := patcher.NewBackup(plan.Info, plan).Save(ev.PatchInfo.BackupDir)
+	if err != nil {
+		errReply(fmt.Errorf("cannot back up blocks before writing: %v", err), reply)
+		return
+	}
+	rep.PatchStatus.BackupPath = backupPath
+	reportProgress(fmt.Sprintf("Original blocks saved to %s", backupPath), reply)
+
+	res, err := patcher.Execute(ctx, chaos, plan, patcher.Options{
+		Revert:     ev.PatchInfo.Revert,
+		Force:      ev.PatchInfo.Force,
+		JournalDir: ev.PatchInfo.JournalDir,
+		Protected:  protected,
+	})
+	rep.PatchStatus.Written = len(res.Written)
+	if err != nil {
+		var blockErr *patcher.BlockError
+		if errors.As(err, &blockErr) || errors.Is(err, context.Canceled) {
+			err = fmt.Errorf("%v; %d of %d blocks written, original blocks are in %s", err, len(res.Written), len(plan.Blocks), backupPath)
+			if ev.PatchInfo.JournalDir != "" {
+				err = fmt.Errorf("%v; connect again to finish or roll back the write", err)
+			}
+		}
+		errReply(err, reply)
+		return
+	}
+	for i := range rep.PatchStatus.Chunks {
+		if rep.PatchStatus.Chunks[i].State != patcher.ChunkNoUndo {
+			rep.PatchStatus.Chunks[i].State = patcher.ChunkDone
+		}
+	}
+	forced := patcher.PatchReport{Chunks: plan.ChunkStatuses(patch)}.Summary(res).Forced > 0
+	if err := recordPatch(ev, plan, forced, backupPath); err != nil {
+		reportProgress(fmt.Sprintf("Cannot record the patch in the ledger: %v", err), reply)
+	}
+	reply <- rep
+}
+
+// recordPatch notes in the device ledger that the loaded patch was applied or reverted,
+// forced over chunks that didn't match if forced is set.
+func recordPatch(ev PatcherCommand, plan *patcher.Plan, forced bool, backupPath string) error {
+	if ev.PatchInfo.LedgerDir == "" {
+		return nil
+	}
+	path := patcher.LedgerPath(ev.PatchInfo.LedgerDir, plan.Info)
+	ledger, err := patcher.LoadLedger(path, plan.Info)
+	if err != nil {
+		return err
+	}
+	e := ledger.Record(patcher.PatchName(ev.PatchInfo.Source), patch.Chunks(), ev.PatchInfo.Revert, backupPath)
+	if forced {
+		e.MarkForced()
+	}
+	return ledger.Save(path)
+}
+
+// defaultBackupDir is where the original blocks are saved before patching.
+func defaultBackupDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(home, "siepatcher_backups")
+}
+
+// chunkLine describes a patch chunk in the chunk list.
+func chunkLine(status patcher.ChunkStatus, checked bool) string {
+	line := fmt.Sprintf("0x%07X: %d bytes", status.Chunk.BaseAddr, status.Chunk.Size())
+	if !checked {
+		return line
+	}
+	line += ", " + status.State.String()
+	if status.Mismatches > 0 {
+		line += fmt.Sprintf(" (%d bytes differ)", status.Mismatches)
+	}
+	return line
+}
+
+// patchSummary describes the result of a patch command for the info box.
+func patchSummary(ev PatcherReply) string {
+	st := ev.PatchStatus
+	action := "applied"
+	if st.Revert {
+		action = "reverted"
+	}
+	switch ev.EventType {
+	case PatchLoaded:
+		return fmt.Sprintf("Patch loaded: %d chunks.\nPress 'Check' to compare it with the flash.", len(st.Chunks))
+	case PatchChecked:
+		if st.CanApply {
+			return fmt.Sprintf("Patch can be %s.", action)
+		}
+		return fmt.Sprintf("Patch can't be %s cleanly, see the chunks below.", action)
+	case PatchApplied:
+		return fmt.Sprintf("Patch %s, %d blocks written.\nOriginal blocks saved to %s", action, st.Written, st.BackupPath)
+	case WriteRecovered:
+		if st.Revert {
+			return fmt.Sprintf("Interrupted write rolled back, %d blocks written.", st.Written)
+		}
+		return fmt.Sprintf("Interrupted write finished, %d blocks written.", st.Written)
+	}
+	return ""
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchlib"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+)
+
+// defaultPatchesDir is where the patch library is kept.
+func defaultPatchesDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(home, "siepatcher_patches")
+}
+
+// runPatches browses the local patch library: "siepatcher patches list|search|show ...".
+func runPatches(args []string) error {
+	flags := flag.NewFlagSet("patches", flag.ExitOnError)
+	dir := flags.String("dir", defaultPatchesDir(), "Directory with VKP patches.")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: siepatcher patches [-dir DIR] list [-fw FIRMWARE] | search [-fw FIRMWARE] WORDS... | show [-save] PATH_OR_ID")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("no command given")
+	}
+
+	cmd, cmdArgs := flags.Arg(0), flags.Args()[1:]
+	switch cmd {
+	case "list", "search":
+		cmdFlags := flag.NewFlagSet(cmd, flag.ExitOnError)
+		firmware := cmdFlags.String("fw", "", "Only show patches for this firmware, like SL75v52.")
+		cmdFlags.Parse(cmdArgs)
+		if cmd == "search" && cmdFlags.NArg() == 0 {
+			return fmt.Errorf("nothing to search for")
+		}
+		lib, err := patchlib.Open(*dir)
+		if err != nil {
+			return err
+		}
+		found := lib.Search(strings.Join(cmdFlags.Args(), " "), *firmware)
+		for _, p := range found {
+			fmt.Println(patchListLine(lib, p))
+		}
+		fmt.Printf("%d of %d patches.\n", len(found), len(lib.Patches))
+		return nil
+	case "show":
+		cmdFlags := flag.NewFlagSet(cmd, flag.ExitOnError)
+		save := cmdFlags.Bool("save", false, "Save a patch fetched from patches.kibab.com to the library.")
+		cmdFlags.Parse(cmdArgs)
+		if cmdFlags.NArg() != 1 {
+			return fmt.Errorf("show needs a patch path or patches.kibab.com ID")
+		}
+		return showPatch(*dir, cmdFlags.Arg(0), *save)
+	}
+	return fmt.Errorf("unknown patches command %q", cmd)
+}
+
+// patchListLine is a one-line summary of a patch.
+func patchListLine(lib *patchlib.Library, p *patchlib.Patch) string {
+	line := fmt.Sprintf("%-10s %s", p.Firmware, p.Name)
+	if p.Author != "" {
+		line += " by " + p.Author
+	}
+	if p.KibabID != 0 {
+		line += fmt.Sprintf(" [#%d]", p.KibabID)
+	}
+	return line + "  " + lib.RelPath(p)
+}
+
+// showPatch prints a patch found in the library, or fetched from patches.kibab.com if ref is an ID.
+func showPatch(dir, ref string, save bool) error {
+	var p patchlib.Patch
+	var text string
+	lib, err := patchlib.Open(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		// No library yet, but the patch may be fetched.
+		lib, err = &patchlib.Library{Dir: dir}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if found, ok := lib.Find(ref); ok {
+		data, err := os.ReadFile(found.Path)
+		if err != nil {
+			return err
+		}
+		p, text = *found, string(data)
+		save = false
+	} else {
+		id, err := strconv.Atoi(ref)
+		if err != nil {
+			return fmt.Errorf("no patch %q in %s", ref, dir)
+		}
+		if p, text, err = patchlib.FetchKibab(id); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Name:        %s\n", p.Name)
+	for _, field := range []struct{ name, value string }{
+		{"Firmware", p.Firmware},
+		{"Author", p.Author},
+		{"Version", p.Version},
+		{"Config ID", p.ConfigID},
+		{"File", p.Path},
+	} {
+		if field.value != "" {
+			fmt.Printf("%-12s %s\n", field.name+":", field.value)
+		}
+	}
+	if p.KibabID != 0 {
+		fmt.Printf("Details:     https://patches.kibab.com/patches/details.php5?id=%d\n", p.KibabID)
+	}
+	for _, line := range p.Description {
+		fmt.Printf("  %s\n", line)
+	}
+
+	pr, err := patchreader.FromString(text)
+	if err != nil {
+		fmt.Printf("Cannot parse the patch: %v\n", err)
+	} else {
+		var size int64
+		for _, chunk := range pr.Chunks() {
+			size += chunk.Size()
+		}
+		fmt.Printf("%d chunks, %d bytes.\n", pr.NumChunks(), size)
+	}
+
+	if save {
+		path := filepath.Join(dir, fmt.Sprintf("%d.vkp", p.KibabID))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Saved to %s\n", path)
+	}
+	return nil
+}
@@ -2,18 +2,24 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"log"
+	"os"
 
 	_ "embed"
 
 	"image/color"
 
+	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/device"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patcher"
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
 )
 
@@ -24,6 +30,15 @@ const (
 	TargetInfo
 	CmdError
 	CmdProgress
+	CancelCommand
+	LoadPatch      // Load a patch from PatchInfo.Source.
+	PatchLoaded    // Reply to LoadPatch.
+	CheckPatch     // Check if the loaded patch can be applied (or reverted).
+	PatchChecked   // Reply to CheckPatch.
+	ApplyPatch     // Apply (or revert) the loaded patch.
+	PatchApplied   // Reply to ApplyPatch.
+	RecoverWrite   // Finish (or roll back, if PatchInfo.Revert is set) the interrupted write found on connection.
+	WriteRecovered // Reply to RecoverWrite.
 )
 
 type ConnectInfoType struct {
@@ -31,11 +46,36 @@ type ConnectInfoType struct {
 	SerialSpeed   string
 	EmuSocketPath string
 	FFPath        string
+	// JournalDir is checked for an interrupted write to the target, see patcher.Journal.
+	JournalDir string
+}
+
+type PatchInfoType struct {
+	// Source is a path to a VKP file or a patch ID on patches.kibab.com.
+	Source    string
+	Revert    bool
+	Force     bool
+	BackupDir string
+	// LedgerDir is where applied patches are recorded, see patcher.Ledger.
+	LedgerDir string
+	// JournalDir keeps the journal of writes, see patcher.Journal.
+	JournalDir string
 }
 
 type PatcherCommand struct {
 	EventType   Event
 	ConnectInfo ConnectInfoType
+	PatchInfo   PatchInfoType
+}
+
+type PatchStatusType struct {
+	Chunks []patcher.ChunkStatus
+	// Checked is set if the chunk states were checked against the target.
+	Checked    bool
+	Revert     bool
+	CanApply   bool
+	Written    int
+	BackupPath string
 }
 
 type PatcherReply struct {
@@ -44,7 +84,12 @@ type PatcherReply struct {
 		PhoneInfo pmb887x.ChaosPhoneInfo
 	}
 	ProgressDescr string
-	ErrorDescr    string
+	// Progress is set for progress of long operations, like reading or writing flash.
+	Progress    pmb887x.Progress
+	PatchStatus PatchStatusType
+	ErrorDescr  string
+	// JournalDescr describes an interrupted write to the target, if TargetInfo found one.
+	JournalDescr string
 }
 
 var (
@@ -53,6 +98,12 @@ var (
 )
 
 func main() {
+	// Command-line subcommands, like "siepatcher diff ...", don't need the GUI.
+	// Other arguments, like -psn_... of macOS, are left to the GUI.
+	if len(os.Args) > 1 && runSubcommand(os.Args[1], os.Args[2:]) {
+		return
+	}
+
 	patcherApp := app.NewWithID("com.kibab.siepatcher")
 	mainWin := patcherApp.NewWindow("SiePatcher")
 
@@ -68,8 +119,8 @@ func main() {
 
 	// Emulator settings: path to socket.
 	emuSocketPath := widget.NewEntry()
-	emuSocketPath.SetPlaceHolder("Path to emulator socket...")
-	emuConfig := container.NewVBox(widget.NewLabel("Socket path:"), emuSocketPath)
+	emuSocketPath.SetPlaceHolder(device.DefaultEmulatorSocket)
+	emuConfig := container.NewVBox(widget.NewLabel("Socket path, tcp:HOST:PORT or tcp-dial:HOST:PORT:"), emuSocketPath)
 
 	// Fullflash file: path to file.
 	ffFilePath := widget.NewEntry()
@@ -99,13 +150,73 @@ func main() {
 	// A status bar.
 	statusIcon := widget.NewIcon(theme.MediaRecordIcon())
 	statusText := canvas.NewText("Offline", color.RGBA{0xFF, 00, 00, 0xFF})
-	statusBar := container.NewHBox(statusIcon, statusText)
+	statusProgress := widget.NewProgressBar()
+	statusProgress.Hide()
+	statusBar := container.NewBorder(nil, nil, container.NewHBox(statusIcon, statusText), nil, statusProgress)
+
+	// Patch: a VKP file or a patch ID on patches.kibab.com.
+	patchSource := widget.NewEntry()
+	patchSource.SetPlaceHolder("VKP file path or patches.kibab.com ID...")
+	openPatchButton := widget.NewButton("Open...", func() {
+		dialog.ShowFileOpen(func(f fyne.URIReadCloser, err error) {
+			if err != nil || f == nil {
+				return
+			}
+			f.Close()
+			patchSource.SetText(f.URI().Path())
+		}, mainWin)
+	})
+	revertPatch := widget.NewCheck("Revert", nil)
+	sendPatchCommand := func(ev Event, force bool) {
+		patcherApp.Preferences().SetString("patch_source", patchSource.Text)
+		patcherCommands <- PatcherCommand{
+			EventType: ev,
+			PatchInfo: PatchInfoType{
+				Source:     patchSource.Text,
+				Revert:     revertPatch.Checked,
+				Force:      force,
+				BackupDir:  patcherApp.Preferences().StringWithFallback("backup_dir", defaultBackupDir()),
+				LedgerDir:  patcherApp.Preferences().StringWithFallback("ledger_dir", patcher.DefaultLedgerDir()),
+				JournalDir: patcherApp.Preferences().StringWithFallback("journal_dir", patcher.DefaultJournalDir()),
+			},
+		}
+	}
+	patchButtons := container.NewHBox(
+		widget.NewButton("Load", func() { sendPatchCommand(LoadPatch, false) }),
+		widget.NewButton("Check", func() { sendPatchCommand(CheckPatch, false) }),
+		widget.NewButton("Apply", func() {
+			action := "apply"
+			if revertPatch.Checked {
+				action = "revert"
+			}
+			question := widget.NewLabel(fmt.Sprintf("Really %s the patch? Original blocks will be backed up first.", action))
+			force := widget.NewCheck("Write over chunks that don't match the flash", nil)
+			dialog.ShowCustomConfirm("Write to flash", "Yes", "No", container.NewVBox(question, force), func(ok bool) {
+				if ok {
+					sendPatchCommand(ApplyPatch, force.Checked)
+				}
+			}, mainWin)
+		}),
+		revertPatch,
+	)
+	patchConfig := container.NewBorder(nil, nil, widget.NewLabel("Patch:"), openPatchButton, patchSource)
 
-	content := container.NewVBox(img, targetConfig, widget.NewButton("Connect and get info", func() {
+	// Chunks of the loaded patch.
+	var patchStatus PatchStatusType
+	chunkList := widget.NewList(
+		func() int { return len(patchStatus.Chunks) },
+		func() fyne.CanvasObject { return widget.NewLabel("") },
+		func(i widget.ListItemID, o fyne.CanvasObject) {
+			o.(*widget.Label).SetText(chunkLine(patchStatus.Chunks[i], patchStatus.Checked))
+		},
+	)
+
+	top := container.NewVBox(img, targetConfig, widget.NewButton("Connect and get info", func() {
 		patcherApp.Preferences().SetString("serial_path", serialName.Text)
 		patcherApp.Preferences().SetString("serial_speed", serialSpeed.Selected)
 		patcherApp.Preferences().SetString("emu_socket_path", emuSocketPath.Text)
 		patcherApp.Preferences().SetString("ff_file_path", ffFilePath.Text)
+		journalDir := patcherApp.Preferences().StringWithFallback("journal_dir", patcher.DefaultJournalDir())
 
 		switch targetConfig.Selected() {
 		case realDeviceTab:
@@ -115,15 +226,31 @@ func main() {
 				ConnectInfo: ConnectInfoType{
 					SerialPath:  serialName.Text,
 					SerialSpeed: serialSpeed.Selected,
+					JournalDir:  journalDir,
 				},
 			}
 			patcherCommands <- cmd
 		case emuTab:
 			log.Printf("Using emulator @ socket path %q", emuSocketPath.Text)
+			socketPath := emuSocketPath.Text
+			if socketPath == "" {
+				socketPath = device.DefaultEmulatorSocket
+			}
+			patcherCommands <- PatcherCommand{
+				EventType:   ConnectTarget,
+				ConnectInfo: ConnectInfoType{EmuSocketPath: socketPath, JournalDir: journalDir},
+			}
 		case ffTab:
 			log.Printf("Using fullflash file @ path %q", ffFilePath.Text)
+			patcherCommands <- PatcherCommand{
+				EventType:   ConnectTarget,
+				ConnectInfo: ConnectInfoType{FFPath: ffFilePath.Text, JournalDir: journalDir},
+			}
 		}
-	}), infoBox, statusBar)
+	}), widget.NewButton("Cancel", func() {
+		patcherCommands <- PatcherCommand{EventType: CancelCommand}
+	}), infoBox, patchConfig, patchButtons)
+	content := container.NewBorder(top, statusBar, nil, nil, chunkList)
 
 	// Load preferences.
 	log.Printf("Serial from settings: %s", patcherApp.Preferences().String("serial_path"))
@@ -132,6 +259,7 @@ func main() {
 	serialSpeed.SetSelected(patcherApp.Preferences().String("serial_speed"))
 	emuSocketPath.Text = patcherApp.Preferences().String("emu_socket_path")
 	ffFilePath.Text = patcherApp.Preferences().String("ff_file_path")
+	patchSource.Text = patcherApp.Preferences().String("patch_source")
 
 	mainWin.SetContent(content)
 
@@ -146,16 +274,37 @@ func main() {
 			log.Printf("Callback: Got a reply %v", ev)
 			switch ev.EventType {
 			case TargetInfo:
-				infoBox.SetText(ev.DeviceInfo.PhoneInfo.String())
+				info := ev.DeviceInfo.PhoneInfo.String()
+				if ev.JournalDescr != "" {
+					info = ev.JournalDescr + "\n\n" + info
+					showRecoverDialog(ev.JournalDescr, mainWin, patcherCommands)
+				}
+				infoBox.SetText(info)
 				statusText.Color = color.RGBA{0, 255, 0, 255}
 				statusText.Text = "Online"
+				statusProgress.Hide()
 				statusBar.Refresh()
+			case WriteRecovered:
+				infoBox.SetText(patchSummary(ev))
+				statusProgress.Hide()
+			case PatchLoaded, PatchChecked, PatchApplied:
+				patchStatus = ev.PatchStatus
+				chunkList.Refresh()
+				infoBox.SetText(patchSummary(ev))
+				statusProgress.Hide()
 			case CmdError:
 				infoBox.SetText(ev.ErrorDescr)
+				statusProgress.Hide()
 			case CmdProgress:
 				log.Printf("Got a progress report: progress = %s", ev.ProgressDescr)
 				statusText.Color = color.RGBA{255, 168, 0, 255}
 				statusText.Text = ev.ProgressDescr
+				if ev.Progress.Total > 0 {
+					statusProgress.SetValue(float64(ev.Progress.Done) / float64(ev.Progress.Total))
+					statusProgress.Show()
+				} else {
+					statusProgress.Hide()
+				}
 				statusBar.Refresh()
 			}
 		}
@@ -163,3 +312,18 @@ func main() {
 
 	mainWin.ShowAndRun()
 }
+
+// showRecoverDialog offers to finish or roll back the interrupted write described by descr.
+func showRecoverDialog(descr string, win fyne.Window, commands chan<- PatcherCommand) {
+	d := dialog.NewCustomWithoutButtons("Interrupted write", widget.NewLabel(descr+"\nNo patch can be applied until it's recovered."), win)
+	recoverWrite := func(rollback bool) {
+		d.Hide()
+		commands <- PatcherCommand{EventType: RecoverWrite, PatchInfo: PatchInfoType{Revert: rollback}}
+	}
+	d.SetButtons([]fyne.CanvasObject{
+		widget.NewButton("Later", d.Hide),
+		widget.NewButton("Roll back", func() { recoverWrite(true) }),
+		widget.NewButton("Finish", func() { recoverWrite(false) }),
+	})
+	d.Show()
+}
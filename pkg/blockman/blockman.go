@@ -56,12 +56,13 @@ func (b *Blockman) AddRegion(blockSize int64, blockCount int) error {
 }
 
 func (b *Blockman) ParamsForAddr(addr int64) (baseAddr, size int64, err error) {
-	if addr < b.baseAddr || addr >= b.endAddr {
-		return -1, -1, fmt.Errorf("addr 0x%X is out of bounds [0x%X, 0x%X)", addr, b.baseAddr, b.endAddr)
+	// endAddr is the last byte of the flash, not the one after it.
+	if addr < b.baseAddr || addr > b.endAddr {
+		return -1, -1, fmt.Errorf("addr 0x%X is out of bounds [0x%X, 0x%X]", addr, b.baseAddr, b.endAddr)
 	}
 	for i := 0; i < len(b.blockRegions); i++ {
 		region := b.blockRegions[i]
-		if addr < region.baseAddr || addr >= region.endAddr {
+		if addr < region.baseAddr || addr > region.endAddr {
 			continue
 		}
 		for blockNo := 0; blockNo < region.blockCount; blockNo++ {
@@ -37,6 +37,25 @@ func TestParamsForAddr(t *testing.T) {
 			blockAddr: 0xA1FE0000,
 			blockSize: 0x8000,
 		},
+		{
+			desc:      "Last address of the first region",
+			addr:      0xA1FDFFFF,
+			wantError: false,
+			blockAddr: 0xA1FC0000,
+			blockSize: 0x20000,
+		},
+		{
+			desc:      "Last address of flash",
+			addr:      bm.EndAddr(),
+			wantError: false,
+			blockAddr: bm.EndAddr() + 1 - 0x20000,
+			blockSize: 0x20000,
+		},
+		{
+			desc:      "First address after flash",
+			addr:      bm.EndAddr() + 1,
+			wantError: true,
+		},
 		{
 			desc:      "Address not in flash",
 			addr:      0xA8001000,
@@ -63,3 +82,23 @@ func TestParamsForAddr(t *testing.T) {
 		}
 	}
 }
+
+func TestGeometryRoundTrip(t *testing.T) {
+	for _, model := range KnownModels() {
+		bm, ok := BlockmapForModel(model)
+		if !ok {
+			t.Fatalf("Model %q: no block map", model)
+		}
+		bm2, err := FromGeometry(bm.Geometry())
+		if err != nil {
+			t.Fatalf("Model %q: cannot create block map from geometry: %v", model, err)
+		}
+		if bm.String() != bm2.String() {
+			t.Errorf("Model %q: got block map\n%s, want\n%s", model, bm2, bm)
+		}
+	}
+
+	if _, err := FromGeometry(Geometry{BaseAddr: 0xA0000000, Regions: []RegionGeometry{{BlockSize: 0, BlockCount: 1}}}); err == nil {
+		t.Errorf("Expected an error for a region with zero block size")
+	}
+}
@@ -19,3 +19,16 @@ func BlockmapForC81() Blockman {
 
 	return bm
 }
+
+// BlockmapForEL71 returns a block map that is used in a real EL71.
+func BlockmapForEL71() Blockman {
+	/*
+		From the real EL71:
+		1 region, start addr 0xA0000000, end addr 0xA3FFFFFF
+			Region #0: [A0000000, A3FFFFFF] 256 blocks, size of each 0x40000
+	*/
+	bm := New(0xA0000000)
+	bm.AddRegion(0x40000, 256)
+
+	return bm
+}
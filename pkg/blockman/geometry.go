@@ -0,0 +1,65 @@
+package blockman
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RegionGeometry describes one erase region: blockCount blocks of blockSize bytes.
+type RegionGeometry struct {
+	BlockSize  int64 `json:"block_size"`
+	BlockCount int   `json:"block_count"`
+}
+
+// Geometry is a serializable description of a flash layout.
+type Geometry struct {
+	BaseAddr int64            `json:"base_addr"`
+	Regions  []RegionGeometry `json:"regions"`
+}
+
+// Geometry returns the layout of b in a serializable form.
+func (b *Blockman) Geometry() Geometry {
+	g := Geometry{BaseAddr: b.baseAddr}
+	for _, reg := range b.blockRegions {
+		g.Regions = append(g.Regions, RegionGeometry{BlockSize: reg.blockSize, BlockCount: reg.blockCount})
+	}
+	return g
+}
+
+// FromGeometry creates a Blockman with the layout described by g.
+func FromGeometry(g Geometry) (Blockman, error) {
+	bm := New(g.BaseAddr)
+	for i, reg := range g.Regions {
+		if reg.BlockSize <= 0 || reg.BlockCount <= 0 {
+			return Blockman{}, fmt.Errorf("region #%d: invalid geometry %d blocks of 0x%X bytes", i, reg.BlockCount, reg.BlockSize)
+		}
+		bm.AddRegion(reg.BlockSize, reg.BlockCount)
+	}
+	return bm, nil
+}
+
+// modelBlockmaps lists flash layouts of known phones, keyed by upper-case model name.
+var modelBlockmaps = map[string]func() Blockman{
+	"C81":  BlockmapForC81,
+	"EL71": BlockmapForEL71,
+}
+
+// BlockmapForModel returns the flash layout of a known phone model.
+func BlockmapForModel(model string) (Blockman, bool) {
+	f, ok := modelBlockmaps[strings.ToUpper(model)]
+	if !ok {
+		return Blockman{}, false
+	}
+	return f(), true
+}
+
+// KnownModels returns names of phone models with known flash layouts.
+func KnownModels() []string {
+	var models []string
+	for model := range modelBlockmaps {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	return models
+}
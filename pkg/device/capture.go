@@ -0,0 +1,152 @@
+package device
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Direction tells which way the bytes of a CaptureRecord went.
+type Direction byte
+
+const (
+	ToDevice   Direction = '>' // Written by us.
+	FromDevice Direction = '<' // Read from the phone.
+)
+
+// CaptureRecord is one read or write in a capture.
+type CaptureRecord struct {
+	// At is the time since the capture started.
+	At   time.Duration
+	Dir  Direction
+	Data []byte
+}
+
+// Capture is a stream that records all the traffic going through it.
+//
+// Every read and write becomes one line of the capture: the time in seconds since
+// the start, a direction ('>' for bytes sent to the phone, '<' for bytes received)
+// and the data in hex. Lines with '#' instead of a direction and lines starting
+// with '#' are comments.
+type Capture struct {
+	stream  io.ReadWriteCloser
+	started time.Time
+
+	mu  sync.Mutex
+	out io.WriteCloser
+	err error
+}
+
+// NewCapture wraps stream, so that all traffic is recorded to out.
+// out is closed together with the stream.
+func NewCapture(stream io.ReadWriteCloser, out io.WriteCloser) *Capture {
+	c := &Capture{stream: stream, out: out, started: time.Now()}
+	c.printf("# siepatcher serial capture, started %s\n", c.started.Format(time.RFC3339))
+	return c
+}
+
+func (c *Capture) printf(format string, args ...interface{}) {
+	if c.err != nil {
+		return
+	}
+	if _, err := fmt.Fprintf(c.out, format, args...); err != nil {
+		// A broken capture must not break flashing.
+		log.Printf("Cannot write capture, stopping: %v", err)
+		c.err = err
+	}
+}
+
+func (c *Capture) record(dir Direction, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.printf("%.6f %c %x\n", time.Since(c.started).Seconds(), dir, data)
+}
+
+// Note adds a comment, like a speed change, to the capture.
+func (c *Capture) Note(format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.printf("%.6f # %s\n", time.Since(c.started).Seconds(), fmt.Sprintf(format, args...))
+}
+
+// Read implements io.Reader.
+func (c *Capture) Read(p []byte) (int, error) {
+	n, err := c.stream.Read(p)
+	if n > 0 {
+		c.record(FromDevice, p[:n])
+	}
+	return n, err
+}
+
+// Write implements io.Writer.
+func (c *Capture) Write(p []byte) (int, error) {
+	// Record before writing, so that the reply can't get into the capture first.
+	if len(p) > 0 {
+		c.record(ToDevice, p)
+	}
+	return c.stream.Write(p)
+}
+
+// Close closes both the stream and the capture.
+func (c *Capture) Close() error {
+	err := c.stream.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cErr := c.out.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// ReadCapture parses a capture written by Capture.
+func ReadCapture(r io.Reader) ([]CaptureRecord, error) {
+	var records []CaptureRecord
+	br := bufio.NewReader(r)
+	for lineNo := 1; ; lineNo++ {
+		line, err := br.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if rec, ok, pErr := parseCaptureLine(line); pErr != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, pErr)
+		} else if ok {
+			records = append(records, rec)
+		}
+		if err != nil {
+			return records, nil
+		}
+	}
+}
+
+func parseCaptureLine(line string) (CaptureRecord, bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return CaptureRecord{}, false, nil
+	}
+	fields := strings.Fields(line)
+	if len(fields) >= 2 && fields[1] == "#" {
+		return CaptureRecord{}, false, nil
+	}
+	if len(fields) != 3 || len(fields[1]) != 1 {
+		return CaptureRecord{}, false, fmt.Errorf("want \"<time> <direction> <hex data>\", got %q", line)
+	}
+	secs, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return CaptureRecord{}, false, fmt.Errorf("bad time %q: %v", fields[0], err)
+	}
+	rec := CaptureRecord{At: time.Duration(secs * float64(time.Second)), Dir: Direction(fields[1][0])}
+	if rec.Dir != ToDevice && rec.Dir != FromDevice {
+		return CaptureRecord{}, false, fmt.Errorf("unknown direction %q", fields[1])
+	}
+	if rec.Data, err = hex.DecodeString(fields[2]); err != nil {
+		return CaptureRecord{}, false, fmt.Errorf("bad data: %v", err)
+	}
+	return rec, true, nil
+}
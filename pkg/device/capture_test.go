@@ -0,0 +1,148 @@
+package device
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/blockman"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
+)
+
+var testBootcode = []byte{0xDE, 0xAD, 0xBE, 0xEF}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// flashSession boots dev and runs a few commands, returning what was read.
+func flashSession(t *testing.T, dev Device, block []byte) ([]byte, error) {
+	t.Helper()
+	ctx := context.Background()
+	if err := dev.ConnectAndBoot(ctx, testBootcode); err != nil {
+		return nil, err
+	}
+	cl := pmb887x.ChaosControllerForDevice(dev.PMB())
+	if err := cl.Activate(ctx); err != nil {
+		return nil, err
+	}
+	if _, err := cl.ReadInfo(ctx); err != nil {
+		return nil, err
+	}
+	if err := cl.WriteFlash(ctx, 0xA0000400, block); err != nil {
+		return nil, err
+	}
+	got := make([]byte, 0x800)
+	if err := cl.ReadFlash(ctx, 0xA0000000, got); err != nil {
+		return nil, err
+	}
+	return got, nil
+}
+
+// simulatorDevice is a Device backed by pmb887x.Simulator with its traffic captured.
+type simulatorDevice struct {
+	sim *pmb887x.Simulator
+	out io.WriteCloser
+	dev pmb887x.Device
+}
+
+func (s *simulatorDevice) Name() string             { return "Simulator" }
+func (s *simulatorDevice) Disconnect() error        { return s.dev.Disconnect() }
+func (s *simulatorDevice) SetSpeed(speed int) error { return nil }
+func (s *simulatorDevice) PMB() pmb887x.Device      { return s.dev }
+
+func (s *simulatorDevice) ConnectAndBoot(ctx context.Context, loaderBin []byte) error {
+	s.dev = pmb887x.NewPMB(NewCapture(s.sim.Connect(), s.out))
+	return s.dev.LoadBoot(ctx, loaderBin)
+}
+
+func TestCaptureReplay(t *testing.T) {
+	bm := blockman.New(0xA0000000)
+	bm.AddRegion(0x400, 8)
+	block := bytes.Repeat([]byte{0x12, 0x34}, 0x200)
+
+	var capture bytes.Buffer
+	sim := &simulatorDevice{sim: pmb887x.NewSimulator(bm, "C81", "354000000000001"), out: nopWriteCloser{&capture}}
+	want, err := flashSession(t, sim, block)
+	if err != nil {
+		t.Fatalf("Session with the simulator failed: %v", err)
+	}
+	sim.Disconnect()
+	if err := sim.sim.Wait(); err != nil {
+		t.Fatalf("Simulator failed: %v", err)
+	}
+
+	records, err := ReadCapture(strings.NewReader(capture.String()))
+	if err != nil {
+		t.Fatalf("ReadCapture() = %v", err)
+	}
+	if len(records) == 0 || records[0].Dir != ToDevice || string(records[0].Data) != "AT" {
+		t.Fatalf("Capture must start with AT, got:\n%s", capture.String())
+	}
+
+	// The same session replays cleanly.
+	replay := NewReplayFromCapture(records)
+	got, err := flashSession(t, replay, block)
+	if err != nil {
+		t.Fatalf("Replayed session failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Replayed session read different data")
+	}
+	if err := replay.Check(); err != nil {
+		t.Errorf("Check() = %v", err)
+	}
+	replay.Disconnect()
+
+	// Writing something else is caught.
+	replay = NewReplayFromCapture(records)
+	if _, err := flashSession(t, replay, bytes.Repeat([]byte{0x56}, 0x400)); err == nil {
+		t.Errorf("Session writing different data replayed without errors")
+	}
+	if err := replay.Check(); err == nil || !strings.Contains(err.Error(), "capture has") {
+		t.Errorf("Check() = %v, want a mismatch", err)
+	}
+	replay.Disconnect()
+
+	// So is a session that stops early.
+	replay = NewReplayFromCapture(records)
+	if err := replay.ConnectAndBoot(context.Background(), testBootcode); err != nil {
+		t.Fatalf("Cannot replay booting: %v", err)
+	}
+	if err := replay.Check(); err == nil {
+		t.Errorf("Check() after booting only = nil, want an error")
+	}
+	replay.Disconnect()
+}
+
+func TestReadCapture(t *testing.T) {
+	capture := `# siepatcher serial capture, started 2024-01-01T12:00:00Z
+0.000000 > 4154
+0.100000 # speed 115200
+
+0.150000 < c0
+`
+	records, err := ReadCapture(strings.NewReader(capture))
+	if err != nil {
+		t.Fatalf("ReadCapture() = %v", err)
+	}
+	if len(records) != 2 || records[1].Dir != FromDevice || !bytes.Equal(records[1].Data, []byte{0xC0}) || records[1].At.Milliseconds() != 150 {
+		t.Errorf("ReadCapture() = %+v", records)
+	}
+
+	for _, bad := range []string{"0.1 ? 41", "x > 41", "0.1 > zz", "0.1 > 41 42"} {
+		if _, err := ReadCapture(strings.NewReader(bad)); err == nil {
+			t.Errorf("ReadCapture(%q) = nil error, want an error", bad)
+		}
+	}
+}
+
+var (
+	_ CapturingDevice = (*Phone)(nil)
+	_ CapturingDevice = (*EmulatorDevice)(nil)
+	_ Device          = (*ReplayDevice)(nil)
+)
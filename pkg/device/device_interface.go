@@ -1,13 +1,25 @@
 package device
 
-import "github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
+import (
+	"context"
+	"io"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
+)
 
 type Device interface {
 	// Name() returns a name and maybe some extra info about this Device. This info is not machine readable.
 	Name() string
-	// Connect() connects to the device. It may block.
-	ConnectAndBoot(loaderBin []byte) error
+	// Connect() connects to the device. It may block until ctx is done.
+	ConnectAndBoot(ctx context.Context, loaderBin []byte) error
 	Disconnect() error
 	SetSpeed(speed int) error
 	PMB() pmb887x.Device
 }
+
+// CapturingDevice is a Device that can record its traffic, see Capture.
+type CapturingDevice interface {
+	Device
+	// SetCapture must be called before ConnectAndBoot.
+	SetCapture(out io.WriteCloser)
+}
@@ -1,62 +1,239 @@
 package device
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
 )
 
 const (
-	emuSock = "/tmp/siemens.sock"
+	// DefaultEmulatorSocket is where pmb887x-emulator connects to by default.
+	DefaultEmulatorSocket = "/tmp/siemens.sock"
+
+	emulatorDialInterval = time.Second
 )
 
+// EmulatorAddress tells how to reach the emulator.
+type EmulatorAddress struct {
+	// Network is "unix" or "tcp".
+	Network string
+	// Address is a socket path for "unix" or host:port for "tcp".
+	Address string
+	// Dial is set if we connect to the emulator instead of waiting for it to connect to us.
+	Dial bool
+}
+
+// ParseEmulatorAddress parses an emulator address. Supported forms are:
+//
+//	/tmp/siemens.sock         wait for the emulator on a UNIX socket
+//	unix:/tmp/siemens.sock    the same
+//	tcp:0.0.0.0:5555          wait for the emulator on a TCP port
+//	tcp-dial:host:5555        connect to the emulator listening on a TCP port
+//	unix-dial:/path/to/sock   connect to the emulator listening on a UNIX socket
+//
+// An empty string means DefaultEmulatorSocket.
+func ParseEmulatorAddress(s string) (EmulatorAddress, error) {
+	if s == "" {
+		s = DefaultEmulatorSocket
+	}
+	scheme, rest, found := strings.Cut(s, ":")
+	if !found || strings.HasPrefix(s, "/") || strings.HasPrefix(s, ".") {
+		return EmulatorAddress{Network: "unix", Address: s}, nil
+	}
+	addr := EmulatorAddress{Address: rest}
+	switch scheme {
+	case "unix":
+		addr.Network = "unix"
+	case "unix-dial":
+		addr.Network = "unix"
+		addr.Dial = true
+	case "tcp":
+		addr.Network = "tcp"
+	case "tcp-dial":
+		addr.Network = "tcp"
+		addr.Dial = true
+	default:
+		return EmulatorAddress{}, fmt.Errorf("unknown emulator address type %q in %q", scheme, s)
+	}
+	if rest == "" {
+		return EmulatorAddress{}, fmt.Errorf("empty emulator address in %q", s)
+	}
+	if addr.Network == "tcp" {
+		if _, _, err := net.SplitHostPort(rest); err != nil {
+			return EmulatorAddress{}, fmt.Errorf("bad TCP address %q: %v", rest, err)
+		}
+	}
+	return addr, nil
+}
+
+// String implements fmt.Stringer.
+func (a EmulatorAddress) String() string {
+	if a.Dial {
+		return fmt.Sprintf("%s-dial:%s", a.Network, a.Address)
+	}
+	return fmt.Sprintf("%s:%s", a.Network, a.Address)
+}
+
 type EmulatorDevice struct {
-	socketPath string
-	listener   net.Listener
-	dev        pmb887x.Device
+	addr     EmulatorAddress
+	listener net.Listener
+	capture  io.WriteCloser
+	dev      pmb887x.Device
 }
 
-func NewEmulatorBackend() (*EmulatorDevice, error) {
-	// Remove the socket file if it already exists
-	if err := os.Remove(emuSock); err != nil && !os.IsNotExist(err) {
-		return nil, fmt.Errorf("error removing existing socket: %v", err)
+// NewEmulatorBackend prepares a connection to the emulator at address,
+// see ParseEmulatorAddress for the format. Unless the address is a dial one,
+// it starts listening right away, so that the emulator can be started afterwards.
+func NewEmulatorBackend(address string) (*EmulatorDevice, error) {
+	addr, err := ParseEmulatorAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	e := &EmulatorDevice{addr: addr}
+	if addr.Dial {
+		return e, nil
+	}
+
+	if addr.Network == "unix" {
+		// Remove the socket file if it already exists
+		if err := os.Remove(addr.Address); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error removing existing socket: %v", err)
+		}
 	}
 
-	// Create a listener for the UNIX socket
-	listener, err := net.Listen("unix", emuSock)
+	e.listener, err = net.Listen(addr.Network, addr.Address)
 	if err != nil {
 		return nil, fmt.Errorf("error creating socket listener %v", err)
 	}
-
-	return &EmulatorDevice{
-		socketPath: emuSock,
-		listener:   listener,
-	}, nil
+	return e, nil
 }
 
 func (e *EmulatorDevice) Name() string {
-	return fmt.Sprintf("pmb887x-emulator on %q", e.socketPath)
+	return fmt.Sprintf("pmb887x-emulator on %q", e.addr)
 }
 
-func (e *EmulatorDevice) ConnectAndBoot(loaderBin []byte) error {
+// Addr returns the address the emulator is expected on. For a listening
+// device, it's the actual address of the listener, so a TCP port 0 is resolved.
+func (e *EmulatorDevice) Addr() EmulatorAddress {
+	if e.listener == nil {
+		return e.addr
+	}
+	return EmulatorAddress{Network: e.addr.Network, Address: e.listener.Addr().String()}
+}
+
+// SetCapture records all the traffic with the emulator to out, see Capture.
+// It must be called before ConnectAndBoot.
+func (e *EmulatorDevice) SetCapture(out io.WriteCloser) {
+	e.capture = out
+}
+
+func (e *EmulatorDevice) ConnectAndBoot(ctx context.Context, loaderBin []byte) error {
+	conn, err := e.connect(ctx)
+	if err != nil {
+		return err
+	}
+	var stream io.ReadWriteCloser = conn
+	if e.capture != nil {
+		stream = NewCapture(conn, e.capture)
+	}
+	e.dev = pmb887x.NewPMB(stream)
+	return e.dev.LoadBoot(ctx, loaderBin)
+}
+
+// connect waits until the emulator connects to us, or connects to it, until ctx is done.
+func (e *EmulatorDevice) connect(ctx context.Context) (net.Conn, error) {
+	if e.addr.Dial {
+		log.Printf("Connecting to emulator at %s", e.addr)
+		conn, err := e.dial(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to emulator: %w", err)
+		}
+		log.Println("Connected to emulator")
+		return conn, nil
+	}
 
 	log.Println("Waiting for emulator to connect")
 	// This blocks until an emulator connects!
-	conn, err := e.listener.Accept()
+	conn, err := e.accept(ctx)
 	if err != nil {
-		return fmt.Errorf("cannot accept emulator connection: %v", err)
+		return nil, fmt.Errorf("cannot accept emulator connection: %w", err)
 	}
 	log.Println("Emulator connected")
+	return conn, nil
+}
 
-	e.dev = pmb887x.NewPMB(conn)
-	return e.dev.LoadBoot(loaderBin)
+// dial connects to the emulator, retrying while it's not up yet.
+func (e *EmulatorDevice) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	for {
+		conn, err := d.DialContext(ctx, e.addr.Network, e.addr.Address)
+		if err == nil {
+			return conn, nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(emulatorDialInterval):
+		}
+	}
+}
+
+// accept waits for an emulator connection until ctx is done.
+func (e *EmulatorDevice) accept(ctx context.Context) (net.Conn, error) {
+	type deadliner interface {
+		SetDeadline(t time.Time) error
+	}
+	dl, ok := e.listener.(deadliner)
+	if !ok {
+		return e.listener.Accept()
+	}
+	if err := dl.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	accepted := make(chan struct{})
+	defer close(accepted)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Wake up Accept.
+			dl.SetDeadline(time.Now())
+		case <-accepted:
+		}
+	}()
+	conn, err := e.listener.Accept()
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return nil, ctxErr
+	}
+	return conn, err
 }
 
+// Disconnect closes the connection to the emulator and stops listening for new ones.
 func (e *EmulatorDevice) Disconnect() error {
-	return e.dev.Disconnect()
+	err := e.dev.Disconnect()
+	if errors.Is(err, pmb887x.ErrNotConnected) {
+		err = nil
+		// The capture is closed with the connection, if there was one.
+		if e.capture != nil {
+			err = e.capture.Close()
+		}
+	}
+	if e.listener != nil {
+		if lErr := e.listener.Close(); err == nil {
+			err = lErr
+		}
+	}
+	return err
 }
 
 func (e *EmulatorDevice) SetSpeed(speed int) error {
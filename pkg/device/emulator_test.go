@@ -0,0 +1,124 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseEmulatorAddress(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    EmulatorAddress
+		wantErr bool
+	}{
+		{in: "", want: EmulatorAddress{Network: "unix", Address: DefaultEmulatorSocket}},
+		{in: "/tmp/emu.sock", want: EmulatorAddress{Network: "unix", Address: "/tmp/emu.sock"}},
+		{in: "./emu.sock", want: EmulatorAddress{Network: "unix", Address: "./emu.sock"}},
+		{in: "unix:/tmp/emu.sock", want: EmulatorAddress{Network: "unix", Address: "/tmp/emu.sock"}},
+		{in: "unix-dial:/tmp/emu.sock", want: EmulatorAddress{Network: "unix", Address: "/tmp/emu.sock", Dial: true}},
+		{in: "tcp:0.0.0.0:5555", want: EmulatorAddress{Network: "tcp", Address: "0.0.0.0:5555"}},
+		{in: "tcp-dial:emu.local:5555", want: EmulatorAddress{Network: "tcp", Address: "emu.local:5555", Dial: true}},
+		{in: "tcp:5555", wantErr: true},
+		{in: "tcp:", wantErr: true},
+		{in: "udp:host:5555", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := ParseEmulatorAddress(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseEmulatorAddress(%q): error %v, want error: %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseEmulatorAddress(%q) = %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestEmulatorListen(t *testing.T) {
+	for _, address := range []string{"tcp:127.0.0.1:0", filepath.Join(t.TempDir(), "emu.sock")} {
+		emu, err := NewEmulatorBackend(address)
+		if err != nil {
+			t.Fatalf("NewEmulatorBackend(%q): %v", address, err)
+		}
+		addr := emu.Addr()
+		go func() {
+			if conn, err := net.Dial(addr.Network, addr.Address); err == nil {
+				conn.Close()
+			}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := emu.connect(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("%q: connect() = %v, want a connection", address, err)
+		}
+		conn.Close()
+		if err := emu.Disconnect(); err != nil {
+			t.Errorf("%q: Disconnect() = %v", address, err)
+		}
+	}
+}
+
+func TestEmulatorDial(t *testing.T) {
+	// Find a free port, and start listening there only after the emulator device started dialing.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().String()
+	l.Close()
+
+	emu, err := NewEmulatorBackend("tcp-dial:" + port)
+	if err != nil {
+		t.Fatalf("NewEmulatorBackend: %v", err)
+	}
+	accepted := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		l, err := net.Listen("tcp", port)
+		if err != nil {
+			accepted <- err
+			return
+		}
+		defer l.Close()
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := emu.connect(ctx)
+	if err != nil {
+		t.Fatalf("connect() = %v, want a connection", err)
+	}
+	conn.Close()
+	if err := <-accepted; err != nil {
+		t.Errorf("emulator side: %v", err)
+	}
+	if err := emu.Disconnect(); err != nil {
+		t.Errorf("Disconnect() = %v", err)
+	}
+}
+
+func TestEmulatorConnectCancel(t *testing.T) {
+	for _, address := range []string{"tcp:127.0.0.1:0", "tcp-dial:127.0.0.1:1"} {
+		emu, err := NewEmulatorBackend(address)
+		if err != nil {
+			t.Fatalf("NewEmulatorBackend(%q): %v", address, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		_, err = emu.connect(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%q: connect() = %v, want %v", address, err, context.DeadlineExceeded)
+		}
+		emu.Disconnect()
+	}
+}
@@ -1,6 +1,7 @@
 package device
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -36,7 +37,7 @@ func (ff *FullflashFile) PMB() pmb887x.Device {
 	return pmb887x.Device{}
 }
 
-func (ff *FullflashFile) ConnectAndBoot(_ []byte) error {
+func (ff *FullflashFile) ConnectAndBoot(_ context.Context, _ []byte) error {
 	if ff.backingStore != nil {
 		return fmt.Errorf("file %q is already open", ff.fileName)
 	}
@@ -1,48 +1,87 @@
 package device
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/blockman"
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
 )
 
 // FullflashLoader implements ChaosLoaderInterface.
 type FullflashLoader struct {
-	ff *FullflashFile
-	bm blockman.Blockman
+	ff   *FullflashFile
+	bm   blockman.Blockman
+	info *pmb887x.ChaosPhoneInfo
 }
 
 func NewLoaderForFullflashFile(ff *FullflashFile) *FullflashLoader {
 	return &FullflashLoader{ff: ff}
 }
 
-func (fl *FullflashLoader) Activate() error {
-	return fl.ff.ConnectAndBoot(nil)
+// SetPhoneInfo sets the phone information (most importantly, the flash geometry)
+// reported by ReadInfo. If not set, it's taken from the metadata file next to the
+// fullflash, see MetadataPath.
+func (fl *FullflashLoader) SetPhoneInfo(info pmb887x.ChaosPhoneInfo) {
+	fl.info = &info
+}
+
+func (fl *FullflashLoader) Activate(ctx context.Context) error {
+	return fl.ff.ConnectAndBoot(ctx, nil)
 }
 
-func (fl *FullflashLoader) Ping() (bool, error) {
+func (fl *FullflashLoader) Ping(_ context.Context) (bool, error) {
 	return true, nil
 }
 
-func (fl *FullflashLoader) SetSpeed(speed int, speedSetter pmb887x.SpeedSetterFunc) error {
+func (fl *FullflashLoader) SetSpeed(_ context.Context, speed int, speedSetter pmb887x.SpeedSetterFunc) error {
 	return nil
 }
 
-func (fl *FullflashLoader) ReadInfo() (pmb887x.ChaosPhoneInfo, error) {
-	// Create a blockmap because a higher-level code needs it.
-	fl.bm = blockman.New(0xA0000000)
+// defaultPhoneInfo fabricates phone info with a flash of 128K blocks for dumps without any metadata.
+func (fl *FullflashLoader) defaultPhoneInfo() pmb887x.ChaosPhoneInfo {
+	bm := blockman.New(0xA0000000)
 	blockSize := int64(0x20000)
 	blockCount := int(fl.ff.Size() / blockSize)
-	fl.bm.AddRegion(blockSize, blockCount)
+	bm.AddRegion(blockSize, blockCount)
 
 	return pmb887x.ChaosPhoneInfo{
 		ModelName:    "Fullflash dump",
 		Manufacturer: "siemens-mobile-hacks Org",
 		IMEI:         "xxxxxxxxxxxxxxx",
-		BlockMap:     fl.bm,
-	}, nil
+		BlockMap:     bm,
+	}
+}
+
+func (fl *FullflashLoader) ReadInfo(_ context.Context) (pmb887x.ChaosPhoneInfo, error) {
+	if fl.info == nil {
+		md, err := LoadFullflashMetadata(MetadataPath(fl.ff.fileName))
+		switch {
+		case err == nil:
+			info, err := md.PhoneInfo()
+			if err != nil {
+				return pmb887x.ChaosPhoneInfo{}, fmt.Errorf("invalid geometry in fullflash metadata: %v", err)
+			}
+			fl.info = &info
+		case errors.Is(err, os.ErrNotExist):
+			info := fl.defaultPhoneInfo()
+			fl.bm = info.BlockMap
+			return info, nil
+		default:
+			return pmb887x.ChaosPhoneInfo{}, err
+		}
+	}
+
+	if flashSize := fl.info.BlockMap.TotalSize(); flashSize != fl.ff.Size() {
+		return pmb887x.ChaosPhoneInfo{}, fmt.Errorf("flash geometry describes 0x%X bytes, but the fullflash has 0x%X bytes", flashSize, fl.ff.Size())
+	}
+	fl.bm = fl.info.BlockMap
+	return *fl.info, nil
 }
 
-func (fl *FullflashLoader) ReadFlash(baseAddr int64, buf []byte) error {
+func (fl *FullflashLoader) ReadFlash(_ context.Context, baseAddr int64, buf []byte) error {
 	sizeToRead := len(buf)
 	readBuf, err := fl.ff.ReadRegion(baseAddr-fl.bm.BaseAddr(), int64(sizeToRead))
 	if err != nil {
@@ -52,6 +91,6 @@ func (fl *FullflashLoader) ReadFlash(baseAddr int64, buf []byte) error {
 	return nil
 }
 
-func (fl *FullflashLoader) WriteFlash(baseAddr int64, buf []byte) error {
+func (fl *FullflashLoader) WriteFlash(_ context.Context, baseAddr int64, buf []byte) error {
 	return fl.ff.WriteRegion(baseAddr-fl.bm.BaseAddr(), buf)
 }
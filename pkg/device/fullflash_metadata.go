@@ -0,0 +1,131 @@
+package device
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/blockman"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
+)
+
+const (
+	// MetadataFileExt is appended to a fullflash path to get the path of its sidecar metadata file.
+	MetadataFileExt = ".json"
+)
+
+// FullflashMetadata describes the phone a fullflash was read from.
+// It is stored as JSON in a sidecar file next to the dump.
+type FullflashMetadata struct {
+	Model        string            `json:"model,omitempty"`
+	Manufacturer string            `json:"manufacturer,omitempty"`
+	IMEI         string            `json:"imei,omitempty"`
+	Geometry     blockman.Geometry `json:"geometry"`
+	// ChaosInfo is the hex-encoded raw reply to Chaos "info" command, if the dump was read with Chaos.
+	ChaosInfo string `json:"chaos_info,omitempty"`
+}
+
+// NewFullflashMetadata creates metadata for a dump of the phone described by info.
+func NewFullflashMetadata(info pmb887x.ChaosPhoneInfo) *FullflashMetadata {
+	return &FullflashMetadata{
+		Model:        strings.TrimRight(info.ModelName, "\x00 "),
+		Manufacturer: strings.TrimRight(info.Manufacturer, "\x00 "),
+		IMEI:         strings.TrimRight(info.IMEI, "\x00 "),
+		Geometry:     info.BlockMap.Geometry(),
+		ChaosInfo:    hex.EncodeToString(info.RawInfo),
+	}
+}
+
+// MetadataPath returns the path of the sidecar metadata file for a fullflash.
+func MetadataPath(fullflashPath string) string {
+	return fullflashPath + MetadataFileExt
+}
+
+// LoadFullflashMetadata reads fullflash metadata from a JSON file.
+func LoadFullflashMetadata(path string) (*FullflashMetadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	md := &FullflashMetadata{}
+	if err := json.Unmarshal(data, md); err != nil {
+		return nil, fmt.Errorf("cannot parse fullflash metadata %q: %v", path, err)
+	}
+	return md, nil
+}
+
+// Save writes the metadata to a JSON file.
+func (md *FullflashMetadata) Save(path string) error {
+	data, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// PhoneInfo converts the metadata to the same form the Chaos bootloader reports.
+// If the metadata has no geometry, it is taken from the saved Chaos info reply.
+func (md *FullflashMetadata) PhoneInfo() (pmb887x.ChaosPhoneInfo, error) {
+	var rawInfo []byte
+	if md.ChaosInfo != "" {
+		var err error
+		if rawInfo, err = hex.DecodeString(md.ChaosInfo); err != nil {
+			return pmb887x.ChaosPhoneInfo{}, fmt.Errorf("cannot decode saved Chaos info: %v", err)
+		}
+	}
+	if len(md.Geometry.Regions) == 0 && rawInfo != nil {
+		return pmb887x.ParseChaosInfo(bytes.NewReader(rawInfo))
+	}
+
+	bm, err := blockman.FromGeometry(md.Geometry)
+	if err != nil {
+		return pmb887x.ChaosPhoneInfo{}, err
+	}
+	return pmb887x.ChaosPhoneInfo{
+		ModelName:    md.Model,
+		Manufacturer: md.Manufacturer,
+		IMEI:         md.IMEI,
+		BlockMap:     bm,
+		RawInfo:      rawInfo,
+	}, nil
+}
+
+// PhoneInfoFromSpec creates phone info for a fullflash from spec, which is one of:
+//   - a known model name, like "C81";
+//   - a path to a JSON file with FullflashMetadata;
+//   - a path to a saved 128-byte reply of Chaos "info" command.
+func PhoneInfoFromSpec(spec string) (pmb887x.ChaosPhoneInfo, error) {
+	if bm, ok := blockman.BlockmapForModel(spec); ok {
+		return pmb887x.ChaosPhoneInfo{
+			ModelName:    strings.ToUpper(spec),
+			Manufacturer: "SIEMENS",
+			BlockMap:     bm,
+		}, nil
+	}
+
+	if strings.HasSuffix(spec, MetadataFileExt) {
+		md, err := LoadFullflashMetadata(spec)
+		if err != nil {
+			return pmb887x.ChaosPhoneInfo{}, err
+		}
+		return md.PhoneInfo()
+	}
+
+	f, err := os.Open(spec)
+	if errors.Is(err, os.ErrNotExist) {
+		return pmb887x.ChaosPhoneInfo{}, fmt.Errorf("%q is neither a known model (%s) nor a file", spec, strings.Join(blockman.KnownModels(), ", "))
+	}
+	if err != nil {
+		return pmb887x.ChaosPhoneInfo{}, err
+	}
+	defer f.Close()
+	info, err := pmb887x.ParseChaosInfo(f)
+	if err != nil {
+		return pmb887x.ChaosPhoneInfo{}, fmt.Errorf("cannot parse Chaos info from %q: %v", spec, err)
+	}
+	return info, nil
+}
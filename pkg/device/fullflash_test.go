@@ -1,8 +1,15 @@
 package device
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/blockman"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
 )
 
 func newDeviceFromBlankFile(size int64) (*FullflashFile, func()) {
@@ -31,7 +38,7 @@ func TestFullflashFile(t *testing.T) {
 	testFF, cleanup := newDeviceFromBlankFile(16)
 	defer cleanup()
 
-	if err := testFF.ConnectAndBoot(nil); err != nil {
+	if err := testFF.ConnectAndBoot(context.Background(), nil); err != nil {
 		t.Fatalf("Error while initializing a test fullflash: %v", err)
 	}
 
@@ -59,3 +66,83 @@ func TestFullflashFile(t *testing.T) {
 	}
 
 }
+
+func TestFullflashLoaderGeometry(t *testing.T) {
+	testFF, cleanup := newDeviceFromBlankFile(0x3000)
+	defer cleanup()
+
+	loader := NewLoaderForFullflashFile(testFF)
+	if err := loader.Activate(context.Background()); err != nil {
+		t.Fatalf("Cannot activate loader: %v", err)
+	}
+	defer testFF.Disconnect()
+
+	md := &FullflashMetadata{
+		Model: "Test",
+		Geometry: blockman.Geometry{
+			BaseAddr: 0xA8000000,
+			Regions:  []blockman.RegionGeometry{{BlockSize: 0x800, BlockCount: 4}, {BlockSize: 0x1000, BlockCount: 1}},
+		},
+	}
+	if err := md.Save(MetadataPath(testFF.fileName)); err != nil {
+		t.Fatalf("Cannot save metadata: %v", err)
+	}
+	defer os.Remove(MetadataPath(testFF.fileName))
+
+	info, err := loader.ReadInfo(context.Background())
+	if err != nil {
+		t.Fatalf("Cannot read info: %v", err)
+	}
+	if info.ModelName != "Test" || info.BlockMap.NumOfRegions() != 2 {
+		t.Fatalf("Unexpected info from metadata: %s", info)
+	}
+	blockAddr, blockSize, err := info.BlockMap.ParamsForAddr(0xA8002000)
+	if err != nil || blockAddr != 0xA8002000 || blockSize != 0x1000 {
+		t.Fatalf("Unexpected block params: 0x%X 0x%X %v", blockAddr, blockSize, err)
+	}
+	if err := loader.WriteFlash(context.Background(), 0xA8002000, []byte{0x12}); err != nil {
+		t.Fatalf("Cannot write flash: %v", err)
+	}
+	if buf, _ := testFF.ReadRegion(0x2000, 1); buf[0] != 0x12 {
+		t.Fatalf("Write went to a wrong place")
+	}
+
+	// A geometry that doesn't match the file size is refused.
+	loader.SetPhoneInfo(pmb887x.ChaosPhoneInfo{BlockMap: blockman.BlockmapForC81()})
+	if _, err := loader.ReadInfo(context.Background()); err == nil {
+		t.Fatalf("Expected ReadInfo() to fail with a wrong geometry")
+	}
+}
+
+func TestFullflashMetadataWithChaosInfo(t *testing.T) {
+	// A reply of a real C81.
+	rawInfo, _ := hex.DecodeString("433831000000000000000000000000005349454D454E5300000000000000000058585858585858585858585858585800664C544260E5CC2931FBF4799D65BE27000000A003C25490000300000000000089000D8802060004FE0000020300800003008000FE0000025052493133A6000000000000000000000000000000000000")
+	info, err := pmb887x.ParseChaosInfo(bytes.NewReader(rawInfo))
+	if err != nil {
+		t.Fatalf("Cannot parse Chaos info: %v", err)
+	}
+
+	md := NewFullflashMetadata(info)
+	if md.Model != "C81" {
+		t.Errorf("Got model %q, want C81", md.Model)
+	}
+
+	// Only the raw reply is enough to restore the geometry.
+	md.Geometry = blockman.Geometry{}
+	mdPath := filepath.Join(t.TempDir(), "ff.bin.json")
+	if err := md.Save(mdPath); err != nil {
+		t.Fatalf("Cannot save metadata: %v", err)
+	}
+	loaded, err := LoadFullflashMetadata(mdPath)
+	if err != nil {
+		t.Fatalf("Cannot load metadata: %v", err)
+	}
+	gotInfo, err := loaded.PhoneInfo()
+	if err != nil {
+		t.Fatalf("Cannot get phone info from metadata: %v", err)
+	}
+	wantBM := blockman.BlockmapForC81()
+	if gotInfo.BlockMap.String() != wantBM.String() || !bytes.Equal(gotInfo.RawInfo, rawInfo) {
+		t.Fatalf("Unexpected phone info from metadata: %s", gotInfo)
+	}
+}
@@ -1,7 +1,10 @@
 package device
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"time"
 
 	"github.com/kibab/goserial"
@@ -12,6 +15,7 @@ import (
 type Phone struct {
 	serialPath string
 	serialPort *goserial.Port
+	capture    *Capture
 	dev        pmb887x.Device
 }
 
@@ -22,9 +26,7 @@ func NewPhone(serialPortNameOrPath string) (*Phone, error) {
 		return nil, fmt.Errorf("cannot open serial port %q: %v", serialPortNameOrPath, err)
 	}
 
-	pmb := pmb887x.NewPMB(serialPort)
 	return &Phone{
-		dev:        pmb,
 		serialPort: serialPort,
 		serialPath: serialPortNameOrPath,
 	}, nil
@@ -34,18 +36,39 @@ func (p *Phone) Name() string {
 	return fmt.Sprintf("Real phone at %q", p.serialPath)
 }
 
-func (p *Phone) ConnectAndBoot(loaderBin []byte) error {
-	if err := p.dev.LoadBoot(loaderBin); err != nil {
+// SetCapture records all the traffic with the phone to out, see Capture.
+// It must be called before ConnectAndBoot.
+func (p *Phone) SetCapture(out io.WriteCloser) {
+	p.capture = NewCapture(p.serialPort, out)
+}
+
+func (p *Phone) ConnectAndBoot(ctx context.Context, loaderBin []byte) error {
+	var stream io.ReadWriteCloser = p.serialPort
+	if p.capture != nil {
+		stream = p.capture
+	}
+	p.dev = pmb887x.NewPMB(stream)
+	if err := p.dev.LoadBoot(ctx, loaderBin); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (p *Phone) Disconnect() error {
-	return p.dev.Disconnect()
+	if err := p.dev.Disconnect(); !errors.Is(err, pmb887x.ErrNotConnected) {
+		return err
+	}
+	// Never connected.
+	if p.capture != nil {
+		return p.capture.Close()
+	}
+	return p.serialPort.Close()
 }
 
 func (p *Phone) SetSpeed(speed int) error {
+	if p.capture != nil {
+		p.capture.Note("speed %d", speed)
+	}
 	return p.serialPort.SetSpeed(speed)
 }
 
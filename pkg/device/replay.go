@@ -0,0 +1,205 @@
+package device
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
+)
+
+// replayIgnoredWrites are writes that may happen any number of times.
+// We send "AT" until the phone answers, and how many of them get through
+// depends on timing, so they are neither checked nor counted.
+var replayIgnoredWrites = [][]byte{[]byte("AT")}
+
+// ReplayDevice plays a capture back instead of talking to a phone.
+//
+// Everything written to it is compared with what was sent in the capture,
+// and every reply is given once all the bytes that preceded it in the capture
+// have been written. Timing of the capture is not reproduced.
+type ReplayDevice struct {
+	name   string
+	stream *replayStream
+	dev    pmb887x.Device
+}
+
+// NewReplayBackend loads a capture written by Capture from capturePath.
+func NewReplayBackend(capturePath string) (*ReplayDevice, error) {
+	f, err := os.Open(capturePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open capture: %v", err)
+	}
+	defer f.Close()
+	records, err := ReadCapture(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read capture %q: %v", capturePath, err)
+	}
+	r := NewReplayFromCapture(records)
+	r.name = fmt.Sprintf("Replay of %q", capturePath)
+	return r, nil
+}
+
+// NewReplayFromCapture creates a device that replays records.
+func NewReplayFromCapture(records []CaptureRecord) *ReplayDevice {
+	return &ReplayDevice{name: "Replay", stream: newReplayStream(records)}
+}
+
+func (r *ReplayDevice) Name() string {
+	return r.name
+}
+
+// ConnectAndBoot replays booting. loaderBin must be the same as in the capture.
+func (r *ReplayDevice) ConnectAndBoot(ctx context.Context, loaderBin []byte) error {
+	r.dev = pmb887x.NewPMB(r.stream)
+	return r.dev.LoadBoot(ctx, loaderBin)
+}
+
+func (r *ReplayDevice) Disconnect() error {
+	return r.dev.Disconnect()
+}
+
+func (r *ReplayDevice) SetSpeed(speed int) error {
+	return nil
+}
+
+func (r *ReplayDevice) PMB() pmb887x.Device {
+	return r.dev
+}
+
+// Check returns an error if what was written differs from the capture,
+// or if not all of the capture was played back.
+func (r *ReplayDevice) Check() error {
+	return r.stream.check()
+}
+
+// replayChunk is data from the phone, given after we've written `after` bytes.
+type replayChunk struct {
+	after int
+	data  []byte
+}
+
+type replayStream struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// want is everything we are expected to write, written is how much of it we did.
+	want    []byte
+	written int
+	replies []replayChunk
+	// The next reply to give and the offset in it.
+	next    int
+	nextOff int
+
+	err    error
+	closed bool
+}
+
+func newReplayStream(records []CaptureRecord) *replayStream {
+	s := &replayStream{}
+	s.cond = sync.NewCond(&s.mu)
+	for _, rec := range records {
+		switch rec.Dir {
+		case ToDevice:
+			if !isIgnoredWrite(rec.Data) {
+				s.want = append(s.want, rec.Data...)
+			}
+		case FromDevice:
+			s.replies = append(s.replies, replayChunk{after: len(s.want), data: rec.Data})
+		}
+	}
+	return s
+}
+
+func isIgnoredWrite(p []byte) bool {
+	for _, w := range replayIgnoredWrites {
+		if bytes.Equal(p, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read gives the next reply as soon as it's due. When the capture is over, it returns io.EOF.
+func (s *replayStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		switch {
+		case s.closed:
+			return 0, io.ErrClosedPipe
+		case s.next >= len(s.replies):
+			return 0, io.EOF
+		case s.written >= s.replies[s.next].after:
+			chunk := s.replies[s.next].data[s.nextOff:]
+			n := copy(p, chunk)
+			s.nextOff += n
+			if s.nextOff == len(s.replies[s.next].data) {
+				s.next++
+				s.nextOff = 0
+			}
+			return n, nil
+		case s.err != nil:
+			// The reply will never come.
+			return 0, s.err
+		}
+		s.cond.Wait()
+	}
+}
+
+// Write checks that p is what comes next in the capture.
+func (s *replayStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.cond.Broadcast()
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	if isIgnoredWrite(p) {
+		return len(p), nil
+	}
+	for i, b := range p {
+		pos := s.written + i
+		if pos >= len(s.want) {
+			s.written = pos
+			s.err = fmt.Errorf("replay: writing past the end of the capture at byte %d", pos)
+			return i, s.err
+		}
+		if b != s.want[pos] {
+			s.written = pos
+			s.err = fmt.Errorf("replay: byte %d written is 0x%02X, capture has 0x%02X", pos, b, s.want[pos])
+			return i, s.err
+		}
+	}
+	s.written += len(p)
+	return len(p), nil
+}
+
+func (s *replayStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *replayStream) check() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.written < len(s.want) {
+		return fmt.Errorf("replay: %d of %d bytes of the capture were not written", len(s.want)-s.written, len(s.want))
+	}
+	if s.next < len(s.replies) {
+		return fmt.Errorf("replay: %d replies of the capture were not read", len(s.replies)-s.next)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package patcher
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
+)
+
+const (
+	backupManifestName = "backup.json"
+	backupTimeFormat   = "20060102-150405"
+)
+
+// ErrWrongDevice is returned when a backup is restored to a device it wasn't made from.
+var ErrWrongDevice = errors.New("backup was made on a different device")
+
+// BackupBlock is one erase block saved in a backup.
+type BackupBlock struct {
+	Addr int64  `json:"addr"`
+	Size int    `json:"size"`
+	File string `json:"file"`
+	Data []byte `json:"-"`
+}
+
+// Backup holds the original contents of the flash blocks a patch is going to overwrite.
+// On disk, it is a zip archive with a JSON manifest and one file per block.
+type Backup struct {
+	Model        string        `json:"model"`
+	Manufacturer string        `json:"manufacturer"`
+	IMEI         string        `json:"imei"`
+	Created      time.Time     `json:"created"`
+	Blocks       []BackupBlock `json:"blocks"`
+}
+
+// trimInfoString removes NUL padding from strings reported by Chaos.
+func trimInfoString(s string) string {
+	return strings.TrimRight(s, "\x00 ")
+}
+
+// NewBackup creates a backup of the original contents of all blocks in the plan.
+func NewBackup(info pmb887x.ChaosPhoneInfo, plan *Plan) *Backup {
+	b := &Backup{
+		Model:        trimInfoString(info.ModelName),
+		Manufacturer: trimInfoString(info.Manufacturer),
+		IMEI:         trimInfoString(info.IMEI),
+		Created:      time.Now(),
+	}
+	for _, block := range plan.Blocks {
+		data := make([]byte, len(block.Original))
+		copy(data, block.Original)
+		b.Blocks = append(b.Blocks, BackupBlock{
+			Addr: block.Addr,
+			Size: len(data),
+			File: fmt.Sprintf("%08X.bin", block.Addr),
+			Data: data,
+		})
+	}
+	return b
+}
+
+// FileName returns a default file name for the backup, like C81_354xxxxxxxxxxxx_20240101-120000.zip.
+func (b *Backup) FileName() string {
+	return fmt.Sprintf("%s_%s_%s.zip", b.Model, b.IMEI, b.Created.Format(backupTimeFormat))
+}
+
+// Save stores the backup in dir and returns the path to the archive.
+func (b *Backup) Save(dir string) (string, error) {
+	path := filepath.Join(dir, b.FileName())
+	if err := b.WriteFile(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// WriteFile stores the backup as a zip archive at path.
+func (b *Backup) WriteFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot create backup file: %w", err)
+	}
+	if err := b.write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write backup %q: %w", path, err)
+	}
+	return f.Close()
+}
+
+func (b *Backup) write(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	manifest, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	mw, err := zw.Create(backupManifestName)
+	if err != nil {
+		return err
+	}
+	if _, err := mw.Write(manifest); err != nil {
+		return err
+	}
+	for _, block := range b.Blocks {
+		bw, err := zw.Create(block.File)
+		if err != nil {
+			return err
+		}
+		if _, err := bw.Write(block.Data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// ReadBackup loads a backup archive created by WriteFile.
+func ReadBackup(path string) (*Backup, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open backup: %w", err)
+	}
+	defer zr.Close()
+
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	readFile := func(name string) ([]byte, error) {
+		f, ok := files[name]
+		if !ok {
+			return nil, fmt.Errorf("backup %q has no %q", path, name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+
+	manifest, err := readFile(backupManifestName)
+	if err != nil {
+		return nil, err
+	}
+	b := &Backup{}
+	if err := json.Unmarshal(manifest, b); err != nil {
+		return nil, fmt.Errorf("cannot parse backup manifest: %w", err)
+	}
+	for i := range b.Blocks {
+		block := &b.Blocks[i]
+		if block.Data, err = readFile(block.File); err != nil {
+			return nil, err
+		}
+		if len(block.Data) != block.Size {
+			return nil, fmt.Errorf("block @ %08X has %d bytes, want %d", block.Addr, len(block.Data), block.Size)
+		}
+	}
+	sort.Slice(b.Blocks, func(i, j int) bool { return b.Blocks[i].Addr < b.Blocks[j].Addr })
+	return b, nil
+}
+
+// RestoreBackup writes all blocks from the backup back to the flash.
+// Unless opts.Force is set, the device must have the same IMEI as the one the backup was made on.
+func RestoreBackup(ctx context.Context, loader pmb887x.ChaosLoaderInterface, b *Backup, opts Options) (*Result, error) {
+	info, err := loader.ReadInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if imei := trimInfoString(info.IMEI); imei != b.IMEI && !opts.Force {
+		return nil, fmt.Errorf("%w: backup IMEI %s, device IMEI %s", ErrWrongDevice, b.IMEI, imei)
+	}
+	plan := &Plan{Info: info}
+	for _, block := range b.Blocks {
+		plan.Blocks = append(plan.Blocks, &Block{Addr: block.Addr, Data: block.Data})
+	}
+	return Execute(ctx, loader, plan, opts)
+}
@@ -0,0 +1,54 @@
+package patcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	loader := newMemLoader()
+	loader.flash[0x10] = 0x55
+	pr, err := patchreader.FromString("10: 55 AA\n100: FF 00\n")
+	if err != nil {
+		t.Fatalf("Cannot parse patch: %v", err)
+	}
+	plan, err := Prepare(context.Background(), loader, pr, false)
+	if err != nil {
+		t.Fatalf("Cannot prepare patch: %v", err)
+	}
+
+	path, err := NewBackup(plan.Info, plan).Save(t.TempDir())
+	if err != nil {
+		t.Fatalf("Cannot save backup: %v", err)
+	}
+	if _, err := Execute(context.Background(), loader, plan, Options{}); err != nil {
+		t.Fatalf("Cannot apply patch: %v", err)
+	}
+
+	backup, err := ReadBackup(path)
+	if err != nil {
+		t.Fatalf("Cannot read backup: %v", err)
+	}
+	if backup.Model != "C81" || backup.IMEI != "354000000000001" || len(backup.Blocks) != 2 {
+		t.Fatalf("Unexpected backup: model %q, IMEI %q, %d blocks", backup.Model, backup.IMEI, len(backup.Blocks))
+	}
+
+	otherPhone := newMemLoader()
+	otherPhone.imei = "354000000000002"
+	if _, err := RestoreBackup(context.Background(), otherPhone, backup, Options{}); !errors.Is(err, ErrWrongDevice) {
+		t.Fatalf("Restoring to another phone: got %v, want ErrWrongDevice", err)
+	}
+
+	if _, err := RestoreBackup(context.Background(), loader, backup, Options{}); err != nil {
+		t.Fatalf("Cannot restore backup: %v", err)
+	}
+	want := newMemLoader()
+	want.flash[0x10] = 0x55
+	if !bytes.Equal(loader.flash, want.flash) {
+		t.Fatalf("Flash contents differ after restoring the backup")
+	}
+}
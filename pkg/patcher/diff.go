@@ -0,0 +1,92 @@
+package patcher
+
+import (
+	"fmt"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+)
+
+const (
+	// diffWindowSize is how much data is compared at once.
+	diffWindowSize = 1024 * 1024
+)
+
+// RegionReader is anything we can read regions of a flash dump from, like device.FullflashFile.
+type RegionReader interface {
+	ReadRegion(baseAddr, size int64) ([]byte, error)
+}
+
+// DiffOptions control how a patch is generated from two flash dumps.
+type DiffOptions struct {
+	// MergeGap: changes separated by at most this many unchanged bytes go into one chunk.
+	MergeGap int64
+	// BaseOffset is added to the offsets in the dumps to get patch addresses.
+	BaseOffset int64
+}
+
+// byteRange is a half-open range [start, end).
+type byteRange struct {
+	start, end int64
+}
+
+// Diff compares size bytes of two flash dumps and returns patch chunks
+// that turn orig into modified.
+func Diff(orig, modified RegionReader, size int64, opts DiffOptions) ([]patchreader.Chunk, error) {
+	var ranges []byteRange
+	for off := int64(0); off < size; off += diffWindowSize {
+		windowSize := int64(diffWindowSize)
+		if off+windowSize > size {
+			windowSize = size - off
+		}
+		origBuf, err := orig.ReadRegion(off, windowSize)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read original dump @ %X: %w", off, err)
+		}
+		modBuf, err := modified.ReadRegion(off, windowSize)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read modified dump @ %X: %w", off, err)
+		}
+		for i := range origBuf {
+			if origBuf[i] == modBuf[i] {
+				continue
+			}
+			addr := off + int64(i)
+			if n := len(ranges); n > 0 && addr-ranges[n-1].end <= opts.MergeGap {
+				ranges[n-1].end = addr + 1
+			} else {
+				ranges = append(ranges, byteRange{start: addr, end: addr + 1})
+			}
+		}
+	}
+
+	chunks := make([]patchreader.Chunk, 0, len(ranges))
+	for _, r := range ranges {
+		oldData, err := orig.ReadRegion(r.start, r.end-r.start)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read original dump @ %X: %w", r.start, err)
+		}
+		newData, err := modified.ReadRegion(r.start, r.end-r.start)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read modified dump @ %X: %w", r.start, err)
+		}
+		chunk := patchreader.Chunk{
+			BaseAddr: r.start + opts.BaseOffset,
+			OldData:  oldData,
+			NewData:  newData,
+			Pragmas:  patchreader.DefaultPragmas(),
+		}
+		chunk.Pragmas.OldEqualFF = allFF(oldData)
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+// allFF returns true if every byte in data is 0xFF (erased flash).
+func allFF(data []byte) bool {
+	for _, b := range data {
+		if b != 0xFF {
+			return false
+		}
+	}
+	return true
+}
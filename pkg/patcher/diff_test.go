@@ -0,0 +1,58 @@
+package patcher
+
+import (
+	"bytes"
+	"testing"
+)
+
+// bytesRegionReader implements RegionReader on top of a byte slice.
+type bytesRegionReader []byte
+
+func (b bytesRegionReader) ReadRegion(baseAddr, size int64) ([]byte, error) {
+	return b[baseAddr : baseAddr+size], nil
+}
+
+func TestDiff(t *testing.T) {
+	orig := make([]byte, diffWindowSize+0x100)
+	for i := range orig {
+		orig[i] = byte(i)
+	}
+	mod := append([]byte{}, orig...)
+	// Two changes close to each other, merged into one chunk.
+	mod[0x10] = 0xAA
+	mod[0x13] = 0xBB
+	// A change far away.
+	mod[0x100] = 0xCC
+	// A change spanning the comparison window boundary.
+	mod[diffWindowSize-1] = 0xDD
+	mod[diffWindowSize] = 0xEE
+	// A change in the erased area.
+	orig[diffWindowSize+0x80] = 0xFF
+	mod[diffWindowSize+0x80] = 0x00
+
+	chunks, err := Diff(bytesRegionReader(orig), bytesRegionReader(mod), int64(len(orig)), DiffOptions{MergeGap: 4, BaseOffset: 0x1000})
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+
+	wantChunks := []struct {
+		addr       int64
+		newData    []byte
+		oldEqualFF bool
+	}{
+		{0x1010, []byte{0xAA, 0x11, 0x12, 0xBB}, false},
+		{0x1100, []byte{0xCC}, false},
+		{0x1000 + diffWindowSize - 1, []byte{0xDD, 0xEE}, false},
+		{0x1000 + diffWindowSize + 0x80, []byte{0x00}, true},
+	}
+	if len(chunks) != len(wantChunks) {
+		t.Fatalf("Got %d chunks, want %d: %+v", len(chunks), len(wantChunks), chunks)
+	}
+	for i, want := range wantChunks {
+		got := chunks[i]
+		if got.BaseAddr != want.addr || !bytes.Equal(got.NewData, want.newData) || got.Pragmas.OldEqualFF != want.oldEqualFF {
+			t.Errorf("Chunk #%d: got @ %X %X (old_equal_ff %t), want @ %X %X (old_equal_ff %t)",
+				i, got.BaseAddr, got.NewData, got.Pragmas.OldEqualFF, want.addr, want.newData, want.oldEqualFF)
+		}
+	}
+}
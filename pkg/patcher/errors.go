@@ -0,0 +1,43 @@
+package patcher
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrMismatch is returned (wrapped in MismatchError) when the flash contents
+// don't match what the patch expects to find there.
+var ErrMismatch = errors.New("flash contents don't match the patch")
+
+// MismatchError lists all bytes that don't match the expected data.
+type MismatchError struct {
+	Mismatches []Mismatch
+}
+
+func (e *MismatchError) Error() string {
+	if len(e.Mismatches) == 0 {
+		return ErrMismatch.Error()
+	}
+	m := e.Mismatches[0]
+	return fmt.Sprintf("%v: %d bytes differ, first at addr 0x%X is %02X, expected %02X",
+		ErrMismatch, len(e.Mismatches), m.Addr, m.Got, m.Want)
+}
+
+func (e *MismatchError) Unwrap() error {
+	return ErrMismatch
+}
+
+// BlockError describes a failure to map, read or write a particular flash block.
+type BlockError struct {
+	Op   string // "map", "read" or "write".
+	Addr int64
+	Err  error
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("cannot %s block @ %08X: %v", e.Op, e.Addr, e.Err)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,285 @@
+package patcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
+)
+
+const journalStateName = "journal.json"
+
+// ErrJournalExists is returned when a write is started while an interrupted one
+// is not recovered yet.
+var ErrJournalExists = errors.New("an interrupted write must be recovered first")
+
+// JournalBlock is one erase block of a journaled write.
+type JournalBlock struct {
+	Addr int64 `json:"addr"`
+	Size int   `json:"size"`
+	// Done is set when the block was written completely.
+	Done bool `json:"done"`
+}
+
+// Journal records a write before it starts, so that it can be finished or
+// rolled back after it's interrupted, e.g. by a power loss.
+//
+// On disk, it is a directory with the state in JSON and the original and the
+// intended contents of every block in separate files.
+type Journal struct {
+	Model   string         `json:"model"`
+	IMEI    string         `json:"imei"`
+	Created time.Time      `json:"created"`
+	Revert  bool           `json:"revert,omitempty"`
+	Blocks  []JournalBlock `json:"blocks"`
+
+	dir string
+}
+
+// JournalDir returns the journal directory of the device in dir.
+func JournalDir(dir string, info pmb887x.ChaosPhoneInfo) string {
+	return filepath.Join(dir, fmt.Sprintf("%s_%s.journal", trimInfoString(info.ModelName), trimInfoString(info.IMEI)))
+}
+
+// DefaultJournalDir is where journals are kept unless told otherwise.
+func DefaultJournalDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(home, "siepatcher_journal")
+}
+
+// writeFileSync writes a file and makes sure it reached the disk.
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	// The rename itself is only durable when the directory is synced.
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the entries of dir to the disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (j *Journal) blockFile(addr int64, kind string) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%08X.%s", addr, kind))
+}
+
+// CreateJournal records the plan in the journal of the device in dir.
+// It fails with ErrJournalExists if there is an unfinished journal already.
+func CreateJournal(dir string, plan *Plan) (*Journal, error) {
+	j := &Journal{
+		Model:   trimInfoString(plan.Info.ModelName),
+		IMEI:    trimInfoString(plan.Info.IMEI),
+		Created: time.Now(),
+		Revert:  plan.Revert,
+		dir:     JournalDir(dir, plan.Info),
+	}
+	if _, err := os.Stat(filepath.Join(j.dir, journalStateName)); err == nil {
+		return nil, fmt.Errorf("%w: found %s", ErrJournalExists, j.dir)
+	}
+	if err := os.MkdirAll(j.dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create journal: %w", err)
+	}
+	for _, block := range plan.Blocks {
+		if err := writeFileSync(j.blockFile(block.Addr, "orig"), block.Original); err != nil {
+			return nil, fmt.Errorf("cannot write journal: %w", err)
+		}
+		if err := writeFileSync(j.blockFile(block.Addr, "new"), block.Data); err != nil {
+			return nil, fmt.Errorf("cannot write journal: %w", err)
+		}
+		j.Blocks = append(j.Blocks, JournalBlock{Addr: block.Addr, Size: len(block.Data)})
+	}
+	// The state goes last: a journal without it was never started.
+	if err := j.save(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// OpenJournal reads the journal of the device in dir. If there is none, it returns nil.
+func OpenJournal(dir string, info pmb887x.ChaosPhoneInfo) (*Journal, error) {
+	j := &Journal{dir: JournalDir(dir, info)}
+	data, err := os.ReadFile(filepath.Join(j.dir, journalStateName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("cannot parse journal %q: %v", j.dir, err)
+	}
+	return j, nil
+}
+
+func (j *Journal) save() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(j.dir, journalStateName), data); err != nil {
+		return fmt.Errorf("cannot write journal: %w", err)
+	}
+	return nil
+}
+
+// Path returns the journal directory.
+func (j *Journal) Path() string {
+	return j.dir
+}
+
+// MarkDone records that the block at addr was written.
+func (j *Journal) MarkDone(addr int64) error {
+	for i := range j.Blocks {
+		if j.Blocks[i].Addr == addr {
+			j.Blocks[i].Done = true
+			return j.save()
+		}
+	}
+	return fmt.Errorf("block @ %08X is not in the journal", addr)
+}
+
+// Done returns the number of blocks written completely.
+func (j *Journal) Done() int {
+	n := 0
+	for _, b := range j.Blocks {
+		if b.Done {
+			n++
+		}
+	}
+	return n
+}
+
+// Remove deletes the journal after the write is finished or rolled back.
+func (j *Journal) Remove() error {
+	return os.RemoveAll(j.dir)
+}
+
+func (j *Journal) readBlock(b JournalBlock, kind string) ([]byte, error) {
+	data, err := os.ReadFile(j.blockFile(b.Addr, kind))
+	if err != nil {
+		return nil, fmt.Errorf("journal is damaged: %w", err)
+	}
+	if len(data) != b.Size {
+		return nil, fmt.Errorf("journal is damaged: block @ %08X has %d bytes instead of %d", b.Addr, len(data), b.Size)
+	}
+	return data, nil
+}
+
+// JournalBlockState tells what is in flash in place of a journaled block.
+type JournalBlockState int
+
+const (
+	BlockOriginal JournalBlockState = iota // The block was not written yet.
+	BlockWritten                           // The block has the intended contents.
+	BlockDamaged                           // Neither: the write was interrupted in the middle.
+)
+
+func (s JournalBlockState) String() string {
+	switch s {
+	case BlockOriginal:
+		return "original"
+	case BlockWritten:
+		return "written"
+	case BlockDamaged:
+		return "damaged"
+	}
+	return "unknown"
+}
+
+// Inspect reads every block of the journal from src and tells what is there.
+func (j *Journal) Inspect(ctx context.Context, src FlashReader) ([]JournalBlockState, error) {
+	states := make([]JournalBlockState, len(j.Blocks))
+	for i, b := range j.Blocks {
+		orig, err := j.readBlock(b, "orig")
+		if err != nil {
+			return nil, err
+		}
+		intended, err := j.readBlock(b, "new")
+		if err != nil {
+			return nil, err
+		}
+		got := make([]byte, b.Size)
+		if err := src.ReadFlash(ctx, b.Addr, got); err != nil {
+			return nil, &BlockError{Op: "read", Addr: b.Addr, Err: err}
+		}
+		switch {
+		case bytes.Equal(got, intended):
+			states[i] = BlockWritten
+		case bytes.Equal(got, orig):
+			states[i] = BlockOriginal
+		default:
+			states[i] = BlockDamaged
+		}
+	}
+	return states, nil
+}
+
+// Recover finishes the interrupted write, or undoes it if rollback is set.
+// Only the blocks that don't have the wanted contents are written.
+// The journal is removed when all blocks are right.
+func (j *Journal) Recover(ctx context.Context, loader pmb887x.ChaosLoaderInterface, rollback bool) (*Result, error) {
+	info, err := loader.ReadInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if imei := trimInfoString(info.IMEI); imei != j.IMEI {
+		return nil, fmt.Errorf("journal is for IMEI %s, phone has %s: %w", j.IMEI, imei, ErrWrongDevice)
+	}
+	states, err := j.Inspect(ctx, loader)
+	if err != nil {
+		return nil, err
+	}
+	kind, done := "new", BlockWritten
+	if rollback {
+		kind, done = "orig", BlockOriginal
+	}
+
+	plan := &Plan{Info: info, Revert: j.Revert != rollback}
+	for i, b := range j.Blocks {
+		if states[i] == done {
+			continue
+		}
+		data, err := j.readBlock(b, kind)
+		if err != nil {
+			return nil, err
+		}
+		plan.Blocks = append(plan.Blocks, &Block{Addr: b.Addr, Data: data})
+	}
+	res, err := writeBlocks(ctx, loader, plan, &Result{Plan: plan}, nil)
+	if err != nil {
+		return res, err
+	}
+	return res, j.Remove()
+}
@@ -0,0 +1,125 @@
+package patcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+)
+
+// failingLoader loses power in the middle of the write number failAt:
+// only half of that block reaches the flash, the rest is garbage.
+type failingLoader struct {
+	*memLoader
+	failAt int
+}
+
+var errPowerLoss = errors.New("power loss")
+
+func (f *failingLoader) WriteFlash(ctx context.Context, baseAddr int64, buf []byte) error {
+	if len(f.writes) == f.failAt {
+		damaged := append([]byte(nil), buf[:len(buf)/2]...)
+		f.memLoader.WriteFlash(ctx, baseAddr, append(damaged, make([]byte, len(buf)-len(damaged))...))
+		return errPowerLoss
+	}
+	return f.memLoader.WriteFlash(ctx, baseAddr, buf)
+}
+
+// interruptedWrite applies a patch touching three blocks and interrupts it on the second one.
+func interruptedWrite(t *testing.T, dir string) (*memLoader, *Journal, []byte) {
+	t.Helper()
+	loader := newMemLoader()
+	before := append([]byte(nil), loader.flash...)
+	pr, err := patchreader.FromString("10: FFFF 1234\n110: FFFF 5678\n210: FFFF 9ABC\n")
+	if err != nil {
+		t.Fatalf("Cannot parse patch: %v", err)
+	}
+	plan, err := Prepare(context.Background(), loader, pr, false)
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	res, err := Execute(context.Background(), &failingLoader{memLoader: loader, failAt: 1}, plan, Options{JournalDir: dir})
+	if !errors.Is(err, errPowerLoss) {
+		t.Fatalf("Got %v, want %v", err, errPowerLoss)
+	}
+	if len(res.Written) != 1 {
+		t.Fatalf("Written %X, want only the first block", res.Written)
+	}
+
+	info, _ := loader.ReadInfo(context.Background())
+	j, err := OpenJournal(dir, info)
+	if err != nil || j == nil {
+		t.Fatalf("OpenJournal: %v, %v", j, err)
+	}
+	if j.Done() != 1 {
+		t.Errorf("Journal has %d blocks done, want 1", j.Done())
+	}
+	states, err := j.Inspect(context.Background(), loader)
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	want := []JournalBlockState{BlockWritten, BlockDamaged, BlockOriginal}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Errorf("Block %d is %v, want %v", i, states[i], want[i])
+		}
+	}
+
+	// Another write must not start until the journal is recovered.
+	if _, err := Execute(context.Background(), loader, plan, Options{JournalDir: dir}); !errors.Is(err, ErrJournalExists) {
+		t.Errorf("Got %v, want %v", err, ErrJournalExists)
+	}
+	return loader, j, before
+}
+
+func TestJournalFinish(t *testing.T) {
+	dir := t.TempDir()
+	loader, j, _ := interruptedWrite(t, dir)
+	loader.writes = nil
+	res, err := j.Recover(context.Background(), loader, false)
+	if err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	if len(res.Written) != 2 || len(loader.writes) != 2 {
+		t.Errorf("Written %X, want the last two blocks", loader.writes)
+	}
+	for addr, want := range map[int64][]byte{0x10: {0x12, 0x34}, 0x110: {0x56, 0x78}, 0x210: {0x9A, 0xBC}} {
+		if got := loader.flash[addr : addr+2]; !bytes.Equal(got, want) {
+			t.Errorf("Flash @ %X is %X, want %X", addr, got, want)
+		}
+	}
+	if _, err := os.Stat(j.Path()); !os.IsNotExist(err) {
+		t.Errorf("Journal is not removed: %v", err)
+	}
+}
+
+func TestJournalRollback(t *testing.T) {
+	dir := t.TempDir()
+	loader, j, before := interruptedWrite(t, dir)
+	if _, err := j.Recover(context.Background(), loader, true); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	if !bytes.Equal(loader.flash, before) {
+		t.Errorf("Flash differs from the original after rollback")
+	}
+	info, _ := loader.ReadInfo(context.Background())
+	if j, err := OpenJournal(dir, info); j != nil || err != nil {
+		t.Errorf("Journal is still there: %v, %v", j, err)
+	}
+}
+
+func TestJournalRemovedOnSuccess(t *testing.T) {
+	dir := t.TempDir()
+	loader := newMemLoader()
+	backup := &Backup{IMEI: "354000000000001", Blocks: []BackupBlock{{Addr: loader.bm.BaseAddr(), Data: bytes.Repeat([]byte{0x55}, 0x100)}}}
+	if _, err := RestoreBackup(context.Background(), loader, backup, Options{JournalDir: dir}); err != nil {
+		t.Fatalf("RestoreBackup failed: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Journal dir has %d entries, %v", len(entries), err)
+	}
+}
@@ -0,0 +1,247 @@
+package patcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
+)
+
+// LedgerChunk is a chunk of a recorded patch, enough to check if it's installed.
+type LedgerChunk struct {
+	Addr int64  `json:"addr"` // Relative to the flash base, as in the patch.
+	Old  []byte `json:"old"`
+	New  []byte `json:"new"`
+}
+
+// LedgerEvent is one time a patch was applied or reverted.
+type LedgerEvent struct {
+	Time   time.Time `json:"time"`
+	Revert bool      `json:"revert,omitempty"`
+	// Backup is the archive with the blocks as they were before, if any.
+	Backup string `json:"backup,omitempty"`
+	// Forced is set if some chunks didn't have the expected data and were written over anyway.
+	Forced bool `json:"forced,omitempty"`
+}
+
+// LedgerEntry is a patch that was applied to (or reverted on) a device.
+type LedgerEntry struct {
+	Name string `json:"name"`
+	// Hash identifies the patch by its chunks, see PatchHash.
+	Hash string `json:"sha256"`
+	// Installed is set if the patch was applied last time, and not reverted.
+	Installed bool          `json:"installed"`
+	History   []LedgerEvent `json:"history"`
+	Chunks    []LedgerChunk `json:"chunks"`
+}
+
+// Updated returns when the patch was applied or reverted last time.
+func (e *LedgerEntry) Updated() time.Time {
+	return e.LastEvent().Time
+}
+
+// LastEvent returns the last time the patch was applied or reverted,
+// or a zero LedgerEvent if there is no history.
+func (e *LedgerEntry) LastEvent() LedgerEvent {
+	if len(e.History) == 0 {
+		return LedgerEvent{}
+	}
+	return e.History[len(e.History)-1]
+}
+
+// Ledger is the list of patches applied to one device.
+type Ledger struct {
+	Model   string         `json:"model"`
+	IMEI    string         `json:"imei"`
+	Patches []*LedgerEntry `json:"patches"`
+}
+
+// PatchHash returns a SHA-256 of the addresses and the data of chunks.
+// Patches that change the same bytes in the same way have the same hash,
+// however their files are formatted.
+func PatchHash(chunks []patchreader.Chunk) string {
+	h := sha256.New()
+	for _, chunk := range chunks {
+		binary.Write(h, binary.LittleEndian, chunk.BaseAddr)
+		binary.Write(h, binary.LittleEndian, int64(len(chunk.NewData)))
+		h.Write(chunk.OldData)
+		h.Write(chunk.NewData)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DefaultLedgerDir is where ledgers are kept unless told otherwise.
+func DefaultLedgerDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(home, "siepatcher_ledger")
+}
+
+// PatchName returns a name to record for a patch loaded with Load from patchFileOrID.
+func PatchName(patchFileOrID string) string {
+	if _, err := strconv.Atoi(patchFileOrID); err == nil {
+		return "patches.kibab.com #" + patchFileOrID
+	}
+	return filepath.Base(patchFileOrID)
+}
+
+// LedgerPath returns the path of the ledger of the device in dir, like C81_354xxxxxxxxxxxx.json.
+func LedgerPath(dir string, info pmb887x.ChaosPhoneInfo) string {
+	return filepath.Join(dir, fmt.Sprintf("%s_%s.json", trimInfoString(info.ModelName), trimInfoString(info.IMEI)))
+}
+
+// LoadLedger reads the ledger of the device from path. If there is no such file yet,
+// an empty ledger is returned.
+func LoadLedger(path string, info pmb887x.ChaosPhoneInfo) (*Ledger, error) {
+	l := &Ledger{Model: trimInfoString(info.ModelName), IMEI: trimInfoString(info.IMEI)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored Ledger
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("cannot parse ledger %q: %v", path, err)
+	}
+	if stored.IMEI != l.IMEI {
+		return nil, fmt.Errorf("ledger %q is for IMEI %s, phone has %s: %w", path, stored.IMEI, l.IMEI, ErrWrongDevice)
+	}
+	return &stored, nil
+}
+
+// Save writes the ledger to path. The old ledger is only replaced when the new one is written completely.
+func (l *Ledger) Save(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Find returns the entry of the patch with the given hash.
+func (l *Ledger) Find(hash string) *LedgerEntry {
+	for _, e := range l.Patches {
+		if e.Hash == hash {
+			return e
+		}
+	}
+	return nil
+}
+
+// Record notes that the patch with chunks was applied (or reverted, if revert is set).
+func (l *Ledger) Record(name string, chunks []patchreader.Chunk, revert bool, backupPath string) *LedgerEntry {
+	hash := PatchHash(chunks)
+	e := l.Find(hash)
+	if e == nil {
+		e = &LedgerEntry{Hash: hash}
+		for _, chunk := range chunks {
+			e.Chunks = append(e.Chunks, LedgerChunk{Addr: chunk.BaseAddr, Old: chunk.OldData, New: chunk.NewData})
+		}
+		l.Patches = append(l.Patches, e)
+	}
+	e.Name = name
+	e.Installed = !revert
+	e.History = append(e.History, LedgerEvent{Time: time.Now(), Revert: revert, Backup: backupPath})
+	return e
+}
+
+// MarkForced notes that the last change of the patch was forced, see LedgerEvent.Forced.
+func (e *LedgerEntry) MarkForced() {
+	if len(e.History) > 0 {
+		e.History[len(e.History)-1].Forced = true
+	}
+}
+
+// InstallState tells if a patch is found in flash.
+type InstallState int
+
+const (
+	NotInstalled       InstallState = iota // All chunks have the old data.
+	Installed                              // All chunks have the new data.
+	PartiallyInstalled                     // Some chunks have the new data, others the old one.
+	Conflicting                            // Some bytes are neither old nor new data.
+)
+
+func (s InstallState) String() string {
+	switch s {
+	case NotInstalled:
+		return "not applied"
+	case Installed:
+		return "applied"
+	case PartiallyInstalled:
+		return "partially applied"
+	case Conflicting:
+		return "conflicting"
+	}
+	return "unknown"
+}
+
+// InstallStatus is the result of CheckInstalled.
+type InstallStatus struct {
+	State InstallState
+	// AppliedChunks of TotalChunks have the new data.
+	AppliedChunks int
+	TotalChunks   int
+	// Conflicts is the number of bytes that are neither old nor new data.
+	Conflicts int
+}
+
+// CheckInstalled reads the flash under every chunk of the entry and tells if the patch is there.
+func (e *LedgerEntry) CheckInstalled(ctx context.Context, src FlashReader, info pmb887x.ChaosPhoneInfo) (InstallStatus, error) {
+	st := InstallStatus{TotalChunks: len(e.Chunks)}
+	oldChunks := 0
+	for _, chunk := range e.Chunks {
+		got := make([]byte, len(chunk.New))
+		addr := info.BlockMap.BaseAddr() + chunk.Addr
+		if err := src.ReadFlash(ctx, addr, got); err != nil {
+			return st, &BlockError{Op: "read", Addr: addr, Err: err}
+		}
+		switch {
+		case bytes.Equal(got, chunk.New):
+			st.AppliedChunks++
+			continue
+		case bytes.Equal(got, chunk.Old):
+			oldChunks++
+			continue
+		}
+		for i, b := range got {
+			if b != chunk.New[i] && b != chunk.Old[i] {
+				st.Conflicts++
+			}
+		}
+	}
+
+	switch {
+	case st.Conflicts > 0:
+		st.State = Conflicting
+	case st.AppliedChunks == st.TotalChunks:
+		st.State = Installed
+	case oldChunks == st.TotalChunks:
+		st.State = NotInstalled
+	default:
+		st.State = PartiallyInstalled
+	}
+	return st, nil
+}
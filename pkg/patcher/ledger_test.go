@@ -0,0 +1,94 @@
+package patcher
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+)
+
+func TestLedger(t *testing.T) {
+	ctx := context.Background()
+	loader := newMemLoader()
+	info, _ := loader.ReadInfo(ctx)
+	path := LedgerPath(t.TempDir(), info)
+	if filepath.Base(path) != "C81_354000000000001.json" {
+		t.Errorf("LedgerPath() = %q", path)
+	}
+
+	pr, err := patchreader.FromString("10: FFFF 1234\n1FE: FFFFFFFF AABBCCDD\n")
+	if err != nil {
+		t.Fatalf("Cannot parse patch: %v", err)
+	}
+	// The same patch, formatted differently.
+	pr2, err := patchreader.FromString("; Comment\n10: FF,FF 12,34\n1FE: FFFFFFFF AABBCCDD\n")
+	if err != nil {
+		t.Fatalf("Cannot parse patch: %v", err)
+	}
+	if PatchHash(pr.Chunks()) != PatchHash(pr2.Chunks()) {
+		t.Errorf("Equal patches have different hashes")
+	}
+
+	ledger, err := LoadLedger(path, info)
+	if err != nil || len(ledger.Patches) != 0 {
+		t.Fatalf("LoadLedger() of a new device = %v, %v", ledger, err)
+	}
+	if _, err := Apply(ctx, loader, pr, Options{}); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	ledger.Record("test.vkp", pr.Chunks(), false, "backup.zip")
+	if err := ledger.Save(path); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+
+	ledger, err = LoadLedger(path, info)
+	if err != nil || len(ledger.Patches) != 1 {
+		t.Fatalf("LoadLedger() = %v, %v; want one patch", ledger, err)
+	}
+	entry := ledger.Patches[0]
+	if !entry.Installed || entry.Name != "test.vkp" || entry.History[0].Backup != "backup.zip" || entry.Updated().IsZero() {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+
+	check := func(want InstallState) {
+		t.Helper()
+		st, err := entry.CheckInstalled(ctx, loader, info)
+		if err != nil {
+			t.Fatalf("CheckInstalled() = %v", err)
+		}
+		if st.State != want {
+			t.Errorf("CheckInstalled() = %+v, want %v", st, want)
+		}
+	}
+	check(Installed)
+
+	// The second chunk is reverted by hand.
+	copy(loader.flash[0x1FE:], []byte{0xFF, 0xFF, 0xFF, 0xFF})
+	check(PartiallyInstalled)
+	loader.flash[0x1FF] = 0x55
+	check(Conflicting)
+
+	if _, err := Apply(ctx, loader, pr2, Options{Revert: true, Force: true}); err != nil {
+		t.Fatalf("Revert failed: %v", err)
+	}
+	check(NotInstalled)
+	ledger.Record("test2.vkp", pr2.Chunks(), true, "").MarkForced()
+	if len(ledger.Patches) != 1 || entry.Installed || len(entry.History) != 2 || !entry.History[1].Revert {
+		t.Errorf("Revert is not recorded in the same entry: %+v", ledger.Patches)
+	}
+	if entry.History[0].Forced || !entry.LastEvent().Forced {
+		t.Errorf("Forced revert is not marked: %+v", entry.History)
+	}
+	if (&LedgerEntry{}).LastEvent() != (LedgerEvent{}) {
+		t.Errorf("Entry without history has a last event")
+	}
+
+	// A ledger of another phone is refused.
+	loader.imei = "354000000000002"
+	other, _ := loader.ReadInfo(ctx)
+	if _, err := LoadLedger(path, other); !errors.Is(err, ErrWrongDevice) {
+		t.Errorf("LoadLedger() for another IMEI = %v, want %v", err, ErrWrongDevice)
+	}
+}
@@ -0,0 +1,191 @@
+package patcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/blockman"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
+)
+
+// NamedPatch is a patch with a name to use in reports.
+type NamedPatch struct {
+	Name  string
+	Patch *patchreader.PatchReader
+}
+
+// Overlap is a byte changed by two patches.
+type Overlap struct {
+	Addr          int64 // Relative to the flash base, as in the patches.
+	First, Second string
+	// Conflict is set if the patches don't agree on the old or the new data of the byte.
+	// The second patch wins, if they are applied anyway.
+	Conflict bool
+}
+
+// ErrConflict is returned (wrapped in ConflictError) when several patches
+// change the same bytes differently.
+var ErrConflict = errors.New("patches change the same bytes differently")
+
+// ConflictError lists the conflicting bytes.
+type ConflictError struct {
+	Conflicts []Overlap
+}
+
+func (e *ConflictError) Error() string {
+	if len(e.Conflicts) == 0 {
+		return ErrConflict.Error()
+	}
+	c := e.Conflicts[0]
+	return fmt.Sprintf("%v: %d bytes, first at addr 0x%X by %q and %q", ErrConflict, len(e.Conflicts), c.Addr, c.First, c.Second)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrConflict
+}
+
+// effectiveChunks returns the chunks of the patch that are written when applying or reverting it.
+func effectiveChunks(pr *patchreader.PatchReader, revert bool) []patchreader.Chunk {
+	var chunks []patchreader.Chunk
+	for _, chunk := range pr.Chunks() {
+		if revert && !chunk.Pragmas.Undo {
+			continue
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// FindOverlaps returns all bytes changed by more than one of the patches, sorted by address.
+func FindOverlaps(patches []NamedPatch, revert bool) []Overlap {
+	type owner struct {
+		patch    int
+		old, new byte
+	}
+	owners := map[int64]owner{}
+	var overlaps []Overlap
+	for i, p := range patches {
+		for _, chunk := range effectiveChunks(p.Patch, revert) {
+			for off := range chunk.NewData {
+				addr := chunk.BaseAddr + int64(off)
+				cur := owner{patch: i, old: chunk.OldData[off], new: chunk.NewData[off]}
+				prev, ok := owners[addr]
+				owners[addr] = cur
+				if !ok || prev.patch == i {
+					continue
+				}
+				overlaps = append(overlaps, Overlap{
+					Addr:     addr,
+					First:    patches[prev.patch].Name,
+					Second:   p.Name,
+					Conflict: prev.old != cur.old || prev.new != cur.new,
+				})
+			}
+		}
+	}
+	sort.SliceStable(overlaps, func(i, j int) bool { return overlaps[i].Addr < overlaps[j].Addr })
+	return overlaps
+}
+
+// PrepareMany is Prepare for several patches at once: their chunks are merged,
+// so that every erase block is read and written only once.
+// Bytes changed by several patches are listed in Plan.Overlaps.
+func PrepareMany(ctx context.Context, loader pmb887x.ChaosLoaderInterface, patches []NamedPatch, revert bool) (*Plan, error) {
+	var chunks []patchreader.Chunk
+	for _, p := range patches {
+		chunks = append(chunks, p.Patch.Chunks()...)
+	}
+	plan, err := prepareChunks(ctx, loader, chunks, revert)
+	if err != nil {
+		return nil, err
+	}
+	plan.Overlaps = FindOverlaps(patches, revert)
+	return plan, nil
+}
+
+// Conflicts returns the overlaps where the patches disagree.
+func (p *Plan) Conflicts() []Overlap {
+	var conflicts []Overlap
+	for _, o := range p.Overlaps {
+		if o.Conflict {
+			conflicts = append(conflicts, o)
+		}
+	}
+	return conflicts
+}
+
+// PatchReport tells what a plan does with one of its patches.
+type PatchReport struct {
+	Name   string
+	Chunks []ChunkStatus
+}
+
+// Count returns the number of chunks in the given state.
+func (r PatchReport) Count(state ChunkState) int {
+	n := 0
+	for _, c := range r.Chunks {
+		if c.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+// Reports returns the state of the chunks of every patch the plan was prepared for.
+func (p *Plan) Reports(patches []NamedPatch) []PatchReport {
+	reports := make([]PatchReport, len(patches))
+	for i, np := range patches {
+		reports[i] = PatchReport{Name: np.Name, Chunks: p.ChunkStatuses(np.Patch)}
+	}
+	return reports
+}
+
+// WriteSummary tells what executing a plan did with the chunks of one patch.
+type WriteSummary struct {
+	Written int // Chunks written as planned.
+	Present int // Chunks that already had the data.
+	Forced  int // Chunks written over data that didn't match.
+	Left    int // Chunks left as they were: can't be undone, or their blocks weren't written.
+}
+
+// Summary counts what res, the result of executing the plan of the report, did with its chunks.
+func (r PatchReport) Summary(res *Result) WriteSummary {
+	written := map[int64]bool{}
+	for _, addr := range res.Written {
+		written[addr] = true
+	}
+	var s WriteSummary
+	for _, c := range r.Chunks {
+		switch {
+		case c.State == ChunkNoUndo:
+			s.Left++
+		case c.State == ChunkDone:
+			s.Present++
+		case !chunkWritten(res.Plan.Info.BlockMap, c.Chunk, written):
+			s.Left++
+		case c.State == ChunkMismatch:
+			s.Forced++
+		default:
+			s.Written++
+		}
+	}
+	return s
+}
+
+// chunkWritten returns true if any erase block of chunk is in written.
+func chunkWritten(bm blockman.Blockman, chunk patchreader.Chunk, written map[int64]bool) bool {
+	for addr := bm.BaseAddr() + chunk.BaseAddr; addr < bm.BaseAddr()+chunk.EndAddr(); {
+		blockAddr, size, err := bm.ParamsForAddr(addr)
+		if err != nil {
+			return false
+		}
+		if written[blockAddr] {
+			return true
+		}
+		addr = blockAddr + size
+	}
+	return false
+}
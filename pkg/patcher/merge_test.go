@@ -0,0 +1,140 @@
+package patcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+)
+
+func namedPatch(t *testing.T, name, text string) NamedPatch {
+	t.Helper()
+	pr, err := patchreader.FromString(text)
+	if err != nil {
+		t.Fatalf("Cannot parse patch %s: %v", name, err)
+	}
+	return NamedPatch{Name: name, Patch: pr}
+}
+
+func TestPrepareMany(t *testing.T) {
+	ctx := context.Background()
+	loader := newMemLoader()
+	loader.flash[0x30] = 0x00
+	patches := []NamedPatch{
+		namedPatch(t, "a.vkp", "10: FFFF 1234\n110: FF 01\n"),
+		// Shares the first block with a.vkp, and one byte with the same data.
+		namedPatch(t, "b.vkp", "20: FFFF 5678\n111: FF 02\n110: FF 01\n"),
+		// Its old data doesn't match.
+		namedPatch(t, "c.vkp", "30: FF 03\n"),
+	}
+
+	plan, err := PrepareMany(ctx, loader, patches, false)
+	if err != nil {
+		t.Fatalf("PrepareMany() = %v", err)
+	}
+	if len(plan.Blocks) != 2 {
+		t.Errorf("Got %d blocks, want 2", len(plan.Blocks))
+	}
+	if len(plan.Overlaps) != 1 || plan.Overlaps[0].Addr != 0x110 || plan.Overlaps[0].Conflict || len(plan.Conflicts()) != 0 {
+		t.Errorf("Overlaps = %+v, want one at 0x110 without a conflict", plan.Overlaps)
+	}
+	reports := plan.Reports(patches)
+	if len(reports) != 3 || reports[0].Count(ChunkReady) != 2 || reports[1].Count(ChunkReady) != 3 || reports[2].Count(ChunkMismatch) != 1 {
+		t.Errorf("Unexpected reports %+v", reports)
+	}
+	if _, err := Execute(ctx, loader, plan, Options{}); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("Execute() = %v, want %v", err, ErrMismatch)
+	}
+
+	// Without c.vkp, every block is written once.
+	plan, err = PrepareMany(ctx, loader, patches[:2], false)
+	if err != nil {
+		t.Fatalf("PrepareMany() = %v", err)
+	}
+	if _, err := Execute(ctx, loader, plan, Options{}); err != nil {
+		t.Fatalf("Execute() = %v", err)
+	}
+	if len(loader.writes) != 2 || loader.writes[0] != 0xA0000000 || loader.writes[1] != 0xA0000100 {
+		t.Errorf("Unexpected writes: %X", loader.writes)
+	}
+	if !bytes.Equal(loader.flash[0x10:0x12], []byte{0x12, 0x34}) || !bytes.Equal(loader.flash[0x20:0x22], []byte{0x56, 0x78}) ||
+		!bytes.Equal(loader.flash[0x110:0x112], []byte{0x01, 0x02}) {
+		t.Errorf("Unexpected flash contents")
+	}
+
+	// Both are reverted together.
+	plan, err = PrepareMany(ctx, loader, patches[:2], true)
+	if err != nil {
+		t.Fatalf("PrepareMany(revert) = %v", err)
+	}
+	if _, err := Execute(ctx, loader, plan, Options{Revert: true}); err != nil {
+		t.Fatalf("Execute(revert) = %v", err)
+	}
+	if !bytes.Equal(loader.flash[0x10:0x12], []byte{0xFF, 0xFF}) || loader.flash[0x111] != 0xFF {
+		t.Errorf("Unexpected flash contents after revert")
+	}
+}
+
+func TestPrepareManyConflict(t *testing.T) {
+	ctx := context.Background()
+	loader := newMemLoader()
+	patches := []NamedPatch{
+		namedPatch(t, "a.vkp", "10: FFFF 1234\n"),
+		namedPatch(t, "b.vkp", "11: FFFF 5678\n"),
+	}
+	plan, err := PrepareMany(ctx, loader, patches, false)
+	if err != nil {
+		t.Fatalf("PrepareMany() = %v", err)
+	}
+	conflicts := plan.Conflicts()
+	if len(conflicts) != 1 || conflicts[0].Addr != 0x11 || conflicts[0].First != "a.vkp" || conflicts[0].Second != "b.vkp" {
+		t.Fatalf("Conflicts() = %+v", conflicts)
+	}
+	if plan.CanApply() {
+		t.Errorf("CanApply() = true for conflicting patches")
+	}
+	var conflictErr *ConflictError
+	if _, err := Execute(ctx, loader, plan, Options{}); !errors.As(err, &conflictErr) || !errors.Is(err, ErrConflict) {
+		t.Fatalf("Execute() = %v, want ConflictError", err)
+	}
+	if len(loader.writes) != 0 {
+		t.Errorf("Conflicting patches were written")
+	}
+
+	// The second patch wins when forced.
+	if _, err := Execute(ctx, loader, plan, Options{Force: true}); err != nil {
+		t.Fatalf("Execute(force) = %v", err)
+	}
+	if !bytes.Equal(loader.flash[0x10:0x13], []byte{0x12, 0x56, 0x78}) {
+		t.Errorf("Unexpected flash contents %X", loader.flash[0x10:0x13])
+	}
+}
+
+func TestWriteSummary(t *testing.T) {
+	ctx := context.Background()
+	loader := newMemLoader()
+	loader.flash[0x30] = 0x00
+	patches := []NamedPatch{
+		namedPatch(t, "a.vkp", "10: FFFF 1234\n"),
+		// Its old data doesn't match.
+		namedPatch(t, "c.vkp", "30: FF 03\n"),
+		// Already in flash.
+		namedPatch(t, "d.vkp", "210: 00 FF\n"),
+	}
+	plan, err := PrepareMany(ctx, loader, patches, false)
+	if err != nil {
+		t.Fatalf("PrepareMany() = %v", err)
+	}
+	res, err := Execute(ctx, loader, plan, Options{Force: true})
+	if err != nil {
+		t.Fatalf("Execute(force) = %v", err)
+	}
+	want := []WriteSummary{{Written: 1}, {Forced: 1}, {Present: 1}}
+	for i, r := range plan.Reports(patches) {
+		if got := r.Summary(res); got != want[i] {
+			t.Errorf("%s: got %+v, want %+v", r.Name, got, want[i])
+		}
+	}
+}
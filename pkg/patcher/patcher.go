@@ -0,0 +1,379 @@
+// Package patcher implements applying, reverting and checking VKP patches
+// against anything that speaks pmb887x.ChaosLoaderInterface.
+package patcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patcheskibabcom"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
+)
+
+// FlashReader is anything we can read flash contents from.
+type FlashReader interface {
+	ReadFlash(ctx context.Context, baseAddr int64, buf []byte) error
+}
+
+// Options control how a patch is applied.
+type Options struct {
+	// Revert the patch instead of applying it.
+	Revert bool
+	// DryRun only checks if the patch can be applied, nothing is written.
+	DryRun bool
+	// Force applies the patch even if the old data doesn't match.
+	Force bool
+	// JournalDir, if set, keeps a journal of the write there, see Journal.
+	JournalDir string
+	// Protected regions are never written, see ProtectedRegions.
+	Protected []ProtectedRegion
+}
+
+// Mismatch describes one byte in flash that differs from what the patch expects.
+type Mismatch struct {
+	Addr int64 // Address relative to the flash base, as in the patch.
+	Got  byte
+	Want byte
+}
+
+// Block is one erase block touched by a patch.
+type Block struct {
+	Addr     int64  // Absolute address of the block.
+	Original []byte // Block contents as read from flash.
+	Data     []byte // Block contents after the patch is applied (or reverted).
+}
+
+// Changed returns true if writing the block would change anything in flash.
+func (b *Block) Changed() bool {
+	return !bytes.Equal(b.Original, b.Data)
+}
+
+// Plan describes what has to be done to apply or revert a patch.
+type Plan struct {
+	Info       pmb887x.ChaosPhoneInfo
+	Revert     bool
+	Blocks     []*Block // Sorted by address.
+	Mismatches []Mismatch
+	NoUndo     []int64 // Chunks that are not reverted because of "#pragma disable undo".
+	// Overlaps are bytes changed by several patches, see PrepareMany.
+	Overlaps []Overlap
+}
+
+// CanApply returns true if the flash contents match the patch expectations
+// and the patches don't conflict.
+func (p *Plan) CanApply() bool {
+	return len(p.Mismatches) == 0 && len(p.Conflicts()) == 0
+}
+
+// Result is the outcome of executing a Plan.
+type Result struct {
+	Plan    *Plan
+	DryRun  bool
+	Written []int64 // Addresses of blocks that were written.
+	Skipped []int64 // Addresses of blocks that already had the data in flash.
+}
+
+// Load loads a patch either from a file or, if patchFileOrID is a number,
+// from patches.kibab.com.
+func Load(patchFileOrID string) (*patchreader.PatchReader, error) {
+	patchID, err := strconv.ParseInt(patchFileOrID, 10, 64)
+	if err != nil {
+		pr, err := patchreader.FromFile(patchFileOrID)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load patch: %w", err)
+		}
+		return pr, nil
+	}
+	patchText, err := patcheskibabcom.PatchByID(int(patchID))
+	if err != nil {
+		return nil, err
+	}
+	pr, err := patchreader.FromString(patchText)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse patch #%d: %w", patchID, err)
+	}
+	return pr, nil
+}
+
+// readBlocks reads every erase block touched by chunks from src.
+func readBlocks(ctx context.Context, info pmb887x.ChaosPhoneInfo, src FlashReader, chunks []patchreader.Chunk) (map[int64]*Block, error) {
+	blockMapper := info.BlockMap
+	blocks := map[int64]*Block{}
+	for _, chunk := range chunks {
+		for addr := chunk.BaseAddr; addr < chunk.EndAddr(); addr++ {
+			baseAddr, size, err := blockMapper.ParamsForAddr(addr + blockMapper.BaseAddr())
+			if err != nil {
+				return nil, &BlockError{Op: "map", Addr: addr + blockMapper.BaseAddr(), Err: err}
+			}
+			if _, ok := blocks[baseAddr]; ok {
+				// This block is cached.
+				continue
+			}
+			block := &Block{Addr: baseAddr, Original: make([]byte, size)}
+			if err := src.ReadFlash(ctx, baseAddr, block.Original); err != nil {
+				return nil, &BlockError{Op: "read", Addr: baseAddr, Err: err}
+			}
+			block.Data = make([]byte, size)
+			copy(block.Data, block.Original)
+			blocks[baseAddr] = block
+		}
+	}
+	return blocks, nil
+}
+
+// sortedBlocks returns the blocks ordered by address.
+func sortedBlocks(blocks map[int64]*Block) []*Block {
+	sorted := make([]*Block, 0, len(blocks))
+	for _, block := range blocks {
+		sorted = append(sorted, block)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Addr < sorted[j].Addr })
+	return sorted
+}
+
+// dataAcceptable decides, according to the chunk pragmas, if the byte got found
+// in flash instead of the expected one can be silently overwritten with newData.
+func dataAcceptable(pragmas patchreader.Pragmas, revert bool, got, newData byte) bool {
+	if got == newData {
+		// The result is already there.
+		if revert {
+			return !pragmas.WarnIfOldExistOnUndo
+		}
+		return !pragmas.WarnIfNewExistOnApply
+	}
+	if !revert {
+		return !pragmas.WarnNoOldOnApply
+	}
+	return false
+}
+
+// Prepare reads all blocks touched by the patch and computes their
+// contents after the patch is applied (or reverted, if revert is true).
+// Bytes that don't match the expected data are listed in Plan.Mismatches.
+func Prepare(ctx context.Context, loader pmb887x.ChaosLoaderInterface, pr *patchreader.PatchReader, revert bool) (*Plan, error) {
+	return prepareChunks(ctx, loader, pr.Chunks(), revert)
+}
+
+// prepareChunks is Prepare for any set of chunks.
+func prepareChunks(ctx context.Context, loader pmb887x.ChaosLoaderInterface, chunks []patchreader.Chunk, revert bool) (*Plan, error) {
+	info, err := loader.ReadInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := readBlocks(ctx, info, loader, chunks)
+	if err != nil {
+		return nil, err
+	}
+
+	blockMapper := info.BlockMap
+	plan := &Plan{Info: info, Revert: revert}
+	for _, chunk := range chunks {
+		if revert && !chunk.Pragmas.Undo {
+			// "#pragma disable undo": this chunk stays as it is.
+			plan.NoUndo = append(plan.NoUndo, chunk.BaseAddr)
+			continue
+		}
+		for addr := chunk.BaseAddr; addr < chunk.EndAddr(); addr++ {
+			// Get the base address of the block the current address is in.
+			// This is also an index in our blocks map.
+			blockBaseAddr, _, _ := blockMapper.ParamsForAddr(addr + blockMapper.BaseAddr())
+			// Offset inside the cached block.
+			blockOff := blockMapper.BaseAddr() + addr - blockBaseAddr
+			// Data offset inside the patch chunk.
+			dataOff := addr - chunk.BaseAddr
+
+			var wantOldData, newData byte
+			if !revert {
+				wantOldData = chunk.OldData[dataOff]
+				newData = chunk.NewData[dataOff]
+			} else {
+				wantOldData = chunk.NewData[dataOff]
+				newData = chunk.OldData[dataOff]
+			}
+			block := blocks[blockBaseAddr]
+			if got := block.Original[blockOff]; got != wantOldData && !dataAcceptable(chunk.Pragmas, revert, got, newData) {
+				plan.Mismatches = append(plan.Mismatches, Mismatch{Addr: addr, Got: got, Want: wantOldData})
+			}
+			block.Data[blockOff] = newData
+		}
+	}
+	plan.Blocks = sortedBlocks(blocks)
+	return plan, nil
+}
+
+// Execute writes the blocks of the plan to the flash in the order of their addresses,
+// stopping at the first error. Blocks known to have the data already are skipped.
+// Progress of the whole plan is reported to the reporter set with pmb887x.WithProgress.
+// Unless opts.Force is set, a plan with conflicts or mismatches is refused
+// with *ConflictError or *MismatchError. Writing to opts.Protected regions is
+// refused with *ProtectedError even then.
+func Execute(ctx context.Context, loader pmb887x.ChaosLoaderInterface, plan *Plan, opts Options) (*Result, error) {
+	res := &Result{Plan: plan, DryRun: opts.DryRun}
+	if conflicts := plan.Conflicts(); len(conflicts) > 0 && !opts.Force {
+		return res, &ConflictError{Conflicts: conflicts}
+	}
+	if !plan.CanApply() && !opts.Force {
+		return res, &MismatchError{Mismatches: plan.Mismatches}
+	}
+	if opts.JournalDir != "" && !opts.DryRun {
+		// Blocks restored from a backup don't know what they replace.
+		if err := readOriginals(ctx, loader, plan.Blocks, false); err != nil {
+			return res, err
+		}
+	}
+
+	// Erasing and programming a block takes much longer than comparing it.
+	toWrite := *plan
+	toWrite.Blocks = nil
+	for _, block := range plan.Blocks {
+		if block.Original != nil && !block.Changed() {
+			res.Skipped = append(res.Skipped, block.Addr)
+			continue
+		}
+		toWrite.Blocks = append(toWrite.Blocks, block)
+	}
+	if err := toWrite.CheckProtected(opts.Protected); err != nil {
+		return res, err
+	}
+	if opts.DryRun {
+		return res, nil
+	}
+	if opts.JournalDir == "" || len(toWrite.Blocks) == 0 {
+		return writeBlocks(ctx, loader, &toWrite, res, nil)
+	}
+
+	journal, err := CreateJournal(opts.JournalDir, &toWrite)
+	if err != nil {
+		return res, err
+	}
+	if _, err := writeBlocks(ctx, loader, &toWrite, res, journal); err != nil {
+		return res, err
+	}
+	return res, journal.Remove()
+}
+
+// readOriginals reads the current contents of blocks from loader.
+// Unless all is set, only blocks without them are read.
+func readOriginals(ctx context.Context, loader FlashReader, blocks []*Block, all bool) error {
+	for _, block := range blocks {
+		if block.Original != nil && !all {
+			continue
+		}
+		block.Original = make([]byte, len(block.Data))
+		if err := loader.ReadFlash(ctx, block.Addr, block.Original); err != nil {
+			return &BlockError{Op: "read", Addr: block.Addr, Err: err}
+		}
+	}
+	return nil
+}
+
+// PrepareImage plans writing data to flash at addr. The range doesn't have to start
+// or end on an erase block boundary: blocks it covers only partly keep the rest of
+// their contents. Every block is read first, so that Execute skips the blocks that
+// already have the data.
+func PrepareImage(ctx context.Context, loader pmb887x.ChaosLoaderInterface, addr int64, data []byte) (*Plan, error) {
+	info, err := loader.ReadInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{Info: info}
+	end := addr + int64(len(data))
+	if len(data) > 0 {
+		// Don't read anything if the range doesn't fit in flash.
+		if _, _, err := info.BlockMap.ParamsForAddr(end - 1); err != nil {
+			return nil, &BlockError{Op: "map", Addr: end - 1, Err: err}
+		}
+	}
+	for cur := addr; cur < end; {
+		blockAddr, size, err := info.BlockMap.ParamsForAddr(cur)
+		if err != nil {
+			return nil, &BlockError{Op: "map", Addr: cur, Err: err}
+		}
+		block := &Block{Addr: blockAddr, Original: make([]byte, size)}
+		if err := loader.ReadFlash(ctx, blockAddr, block.Original); err != nil {
+			return nil, &BlockError{Op: "read", Addr: blockAddr, Err: err}
+		}
+		block.Data = make([]byte, size)
+		copy(block.Data, block.Original)
+
+		// The part of data that goes to this block.
+		blockEnd := blockAddr + size
+		if blockEnd > end {
+			blockEnd = end
+		}
+		copy(block.Data[cur-blockAddr:blockEnd-blockAddr], data[cur-addr:blockEnd-addr])
+		plan.Blocks = append(plan.Blocks, block)
+		cur = blockEnd
+	}
+	return plan, nil
+}
+
+// WriteRange writes data to flash at addr, see PrepareImage.
+func WriteRange(ctx context.Context, loader pmb887x.ChaosLoaderInterface, addr int64, data []byte, opts Options) (*Result, error) {
+	plan, err := PrepareImage(ctx, loader, addr, data)
+	if err != nil {
+		return nil, err
+	}
+	return Execute(ctx, loader, plan, opts)
+}
+
+// writeBlocks writes the blocks of the plan in order, stopping at the first error.
+// Every block written is added to res and, if there is a journal, marked done in it.
+func writeBlocks(ctx context.Context, loader pmb887x.ChaosLoaderInterface, plan *Plan, res *Result, journal *Journal) (*Result, error) {
+	var total int64
+	for _, block := range plan.Blocks {
+		total += int64(len(block.Data))
+	}
+	op := pmb887x.StartOperation(ctx, total)
+	for _, block := range plan.Blocks {
+		if err := ctx.Err(); err != nil {
+			// Don't start writing the next block after cancellation.
+			return res, err
+		}
+		if err := loader.WriteFlash(op.Step(ctx), block.Addr, block.Data); err != nil {
+			return res, &BlockError{Op: "write", Addr: block.Addr, Err: err}
+		}
+		op.Advance(int64(len(block.Data)))
+		op.Report(pmb887x.PhaseWriting, block.Addr, 0)
+		res.Written = append(res.Written, block.Addr)
+		if journal != nil {
+			if err := journal.MarkDone(block.Addr); err != nil {
+				return res, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// Apply applies (or reverts) the patch according to opts.
+func Apply(ctx context.Context, loader pmb887x.ChaosLoaderInterface, pr *patchreader.PatchReader, opts Options) (*Result, error) {
+	plan, err := Prepare(ctx, loader, pr, opts.Revert)
+	if err != nil {
+		return nil, err
+	}
+	return Execute(ctx, loader, plan, opts)
+}
+
+// RestoreFromFlash writes the blocks touched by the patch back to the loader,
+// taking their contents from src (usually a fullflash backup).
+// Blocks that are the same in src and in the loader are not written.
+func RestoreFromFlash(ctx context.Context, loader pmb887x.ChaosLoaderInterface, pr *patchreader.PatchReader, src FlashReader, opts Options) (*Result, error) {
+	info, err := loader.ReadInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := readBlocks(ctx, info, src, pr.Chunks())
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{Info: info, Blocks: sortedBlocks(blocks)}
+	// What was read from src is what we want to write, see what is there now.
+	if err := readOriginals(ctx, loader, plan.Blocks, true); err != nil {
+		return nil, err
+	}
+	return Execute(ctx, loader, plan, opts)
+}
@@ -0,0 +1,266 @@
+package patcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/blockman"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
+)
+
+// memLoader is an in-memory flash implementing ChaosLoaderInterface.
+type memLoader struct {
+	bm     blockman.Blockman
+	imei   string
+	flash  []byte
+	writes []int64
+}
+
+func newMemLoader() *memLoader {
+	bm := blockman.New(0xA0000000)
+	bm.AddRegion(0x100, 4)
+	flash := make([]byte, bm.TotalSize())
+	for i := range flash {
+		flash[i] = 0xFF
+	}
+	return &memLoader{bm: bm, imei: "354000000000001\x00", flash: flash}
+}
+
+func (m *memLoader) Activate(_ context.Context) error     { return nil }
+func (m *memLoader) Ping(_ context.Context) (bool, error) { return true, nil }
+func (m *memLoader) SetSpeed(_ context.Context, speed int, speedSetter pmb887x.SpeedSetterFunc) error {
+	return nil
+}
+func (m *memLoader) ReadInfo(_ context.Context) (pmb887x.ChaosPhoneInfo, error) {
+	return pmb887x.ChaosPhoneInfo{ModelName: "C81\x00\x00", IMEI: m.imei, BlockMap: m.bm}, nil
+}
+func (m *memLoader) ReadFlash(_ context.Context, baseAddr int64, buf []byte) error {
+	copy(buf, m.flash[baseAddr-m.bm.BaseAddr():])
+	return nil
+}
+func (m *memLoader) WriteFlash(_ context.Context, baseAddr int64, buf []byte) error {
+	m.writes = append(m.writes, baseAddr)
+	copy(m.flash[baseAddr-m.bm.BaseAddr():], buf)
+	return nil
+}
+
+func TestApplyAndRevert(t *testing.T) {
+	loader := newMemLoader()
+	// The second chunk spans two blocks.
+	pr, err := patchreader.FromString("10: FFFF 1234\n1FE: FFFFFFFF AABBCCDD\n")
+	if err != nil {
+		t.Fatalf("Cannot parse patch: %v", err)
+	}
+
+	res, err := Apply(context.Background(), loader, pr, Options{DryRun: true})
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if len(res.Plan.Blocks) != 3 || len(res.Written) != 0 {
+		t.Fatalf("Dry run: got %d blocks, %d written; want 3, 0", len(res.Plan.Blocks), len(res.Written))
+	}
+
+	if _, err := Apply(context.Background(), loader, pr, Options{}); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if !bytes.Equal(loader.flash[0x1FE:0x202], []byte{0xAA, 0xBB, 0xCC, 0xDD}) {
+		t.Fatalf("Unexpected flash contents after apply: %X", loader.flash[0x1FE:0x202])
+	}
+	if len(loader.writes) != 3 || loader.writes[0] != 0xA0000000 || loader.writes[2] != 0xA0000200 {
+		t.Fatalf("Unexpected writes: %X", loader.writes)
+	}
+
+	// Applying it again must fail, because the old data is gone.
+	_, err = Apply(context.Background(), loader, pr, Options{})
+	var mismatchErr *MismatchError
+	if !errors.As(err, &mismatchErr) || !errors.Is(err, ErrMismatch) {
+		t.Fatalf("Second apply: got %v, want MismatchError", err)
+	}
+	if len(mismatchErr.Mismatches) != 6 {
+		t.Fatalf("Second apply: got %d mismatches, want 6", len(mismatchErr.Mismatches))
+	}
+
+	if _, err := Apply(context.Background(), loader, pr, Options{Revert: true}); err != nil {
+		t.Fatalf("Revert failed: %v", err)
+	}
+	for i, b := range loader.flash {
+		if b != 0xFF {
+			t.Fatalf("Byte at 0x%X is %02X after revert, want FF", i, b)
+		}
+	}
+}
+
+func TestOutOfFlash(t *testing.T) {
+	loader := newMemLoader()
+	pr, err := patchreader.FromString("1000: FF 00\n")
+	if err != nil {
+		t.Fatalf("Cannot parse patch: %v", err)
+	}
+	_, err = Apply(context.Background(), loader, pr, Options{})
+	var blockErr *BlockError
+	if !errors.As(err, &blockErr) || blockErr.Op != "map" {
+		t.Fatalf("Got %v, want a map BlockError", err)
+	}
+}
+
+func TestExecuteCancelled(t *testing.T) {
+	loader := newMemLoader()
+	pr, err := patchreader.FromString("10: FFFF 1234\n")
+	if err != nil {
+		t.Fatalf("Cannot parse patch: %v", err)
+	}
+	plan, err := Prepare(context.Background(), loader, pr, false)
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Execute(ctx, loader, plan, Options{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Got %v, want %v", err, context.Canceled)
+	}
+	if len(loader.writes) != 0 {
+		t.Fatalf("Unexpected writes after cancellation: %X", loader.writes)
+	}
+}
+
+func TestPragmas(t *testing.T) {
+	testCases := []struct {
+		descr        string
+		patch        string
+		flash        []byte // Contents at address 0x10.
+		revert       bool
+		wantMismatch bool
+		wantFlash    []byte
+	}{
+		{
+			descr:        "New data already present",
+			patch:        "10: FF 12\n",
+			flash:        []byte{0x12},
+			wantMismatch: true,
+		},
+		{
+			descr:     "New data already present, warning disabled",
+			patch:     "#pragma disable warn_if_new_exist_on_apply\n10: FF 12\n",
+			flash:     []byte{0x12},
+			wantFlash: []byte{0x12},
+		},
+		{
+			descr:        "No old data",
+			patch:        "10: FF 12\n",
+			flash:        []byte{0x34},
+			wantMismatch: true,
+		},
+		{
+			descr:     "No old data, warning disabled",
+			patch:     "#pragma disable warn_no_old_on_apply\n10: FF 12\n",
+			flash:     []byte{0x34},
+			wantFlash: []byte{0x12},
+		},
+		{
+			descr:        "Old data already present on undo",
+			patch:        "10: FF 12\n",
+			flash:        []byte{0xFF},
+			revert:       true,
+			wantMismatch: true,
+		},
+		{
+			descr:     "Old data already present on undo, warning disabled",
+			patch:     "#pragma disable warn_if_old_exist_on_undo\n10: FF 12\n",
+			flash:     []byte{0xFF},
+			revert:    true,
+			wantFlash: []byte{0xFF},
+		},
+		{
+			descr:     "Undo disabled",
+			patch:     "#pragma disable undo\n10: FF 12\n#pragma enable undo\n11: FF 34\n",
+			flash:     []byte{0x12, 0x34},
+			revert:    true,
+			wantFlash: []byte{0x12, 0xFF},
+		},
+	}
+
+	for _, tc := range testCases {
+		loader := newMemLoader()
+		copy(loader.flash[0x10:], tc.flash)
+		pr, err := patchreader.FromString(tc.patch)
+		if err != nil {
+			t.Fatalf("Test %q: cannot parse patch: %v", tc.descr, err)
+		}
+		_, err = Apply(context.Background(), loader, pr, Options{Revert: tc.revert})
+		if errors.Is(err, ErrMismatch) != tc.wantMismatch {
+			t.Errorf("Test %q: got %v, want mismatch = %t", tc.descr, err, tc.wantMismatch)
+			continue
+		}
+		if err == nil && !bytes.Equal(loader.flash[0x10:0x10+len(tc.wantFlash)], tc.wantFlash) {
+			t.Errorf("Test %q: got flash %X, want %X", tc.descr, loader.flash[0x10:0x10+len(tc.wantFlash)], tc.wantFlash)
+		}
+	}
+}
+
+func TestPrepareImageSkipsUnchanged(t *testing.T) {
+	loader := newMemLoader()
+	image := append([]byte(nil), loader.flash...)
+	image[0x210] = 0x42
+
+	plan, err := PrepareImage(context.Background(), loader, loader.bm.BaseAddr(), image)
+	if err != nil {
+		t.Fatalf("PrepareImage failed: %v", err)
+	}
+	if len(plan.Blocks) != 4 {
+		t.Fatalf("Got %d blocks, want 4", len(plan.Blocks))
+	}
+	res, err := Execute(context.Background(), loader, plan, Options{})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if len(loader.writes) != 1 || loader.writes[0] != 0xA0000200 {
+		t.Errorf("Unexpected writes: %X", loader.writes)
+	}
+	if len(res.Skipped) != 3 {
+		t.Errorf("Skipped %X, want 3 blocks", res.Skipped)
+	}
+	if !bytes.Equal(loader.flash, image) {
+		t.Errorf("Flash differs from the image")
+	}
+
+}
+
+func TestWriteRangeUnaligned(t *testing.T) {
+	loader := newMemLoader()
+	for i := range loader.flash {
+		loader.flash[i] = byte(i)
+	}
+	before := append([]byte(nil), loader.flash...)
+	data := bytes.Repeat([]byte{0xEE}, 0x100)
+
+	// From the middle of the first block to the middle of the second one.
+	res, err := WriteRange(context.Background(), loader, loader.bm.BaseAddr()+0xF0, data, Options{})
+	if err != nil {
+		t.Fatalf("WriteRange failed: %v", err)
+	}
+	if len(res.Written) != 2 || loader.writes[0] != 0xA0000000 || loader.writes[1] != 0xA0000100 {
+		t.Errorf("Unexpected writes: %X", loader.writes)
+	}
+	want := append([]byte(nil), before...)
+	copy(want[0xF0:], data)
+	if !bytes.Equal(loader.flash, want) {
+		t.Errorf("Flash around the range is changed")
+	}
+
+	// The very last byte of flash.
+	loader.writes = nil
+	if _, err := WriteRange(context.Background(), loader, loader.bm.EndAddr(), []byte{0x42}, Options{}); err != nil {
+		t.Fatalf("WriteRange at the end of flash failed: %v", err)
+	}
+	if got := loader.flash[len(loader.flash)-1]; got != 0x42 || len(loader.writes) != 1 || loader.writes[0] != 0xA0000300 {
+		t.Errorf("Last byte is %02X, writes %X", got, loader.writes)
+	}
+
+	var blockErr *BlockError
+	if _, err := WriteRange(context.Background(), loader, loader.bm.EndAddr(), []byte{1, 2}, Options{}); !errors.As(err, &blockErr) || blockErr.Op != "map" {
+		t.Errorf("Got %v, want a map BlockError for a range past the end of flash", err)
+	}
+}
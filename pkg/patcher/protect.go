@@ -0,0 +1,247 @@
+package patcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/blockman"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/pmb887x"
+)
+
+// ProtectedRegion is a part of flash that is not written unless explicitly allowed:
+// erasing it makes the phone unbootable or loses its calibration.
+type ProtectedRegion struct {
+	Name string `json:"name"` // Like "boot", "eeprom" or "ffs".
+	Addr int64  `json:"addr"` // Relative to the flash base.
+	Size int64  `json:"size"`
+}
+
+func (r ProtectedRegion) String() string {
+	return fmt.Sprintf("%s [%X, %X)", r.Name, r.Addr, r.Addr+r.Size)
+}
+
+// overlaps returns true if size bytes at addr (relative to the flash base) touch the region.
+func (r ProtectedRegion) overlaps(addr, size int64) bool {
+	return addr < r.Addr+r.Size && r.Addr < addr+size
+}
+
+// AllRegions passed to AllowRegions removes the protection completely.
+const AllRegions = "all"
+
+// ErrProtected is returned (wrapped in ProtectedError) when a write would erase a protected region.
+var ErrProtected = errors.New("write to a protected flash region")
+
+// ProtectedHit is an erase block that would be written over a protected region.
+type ProtectedHit struct {
+	Region string
+	Block  int64 // Absolute address of the block.
+}
+
+// ProtectedError lists the blocks that were not written because of protection.
+type ProtectedError struct {
+	Hits []ProtectedHit
+}
+
+func (e *ProtectedError) Error() string {
+	if len(e.Hits) == 0 {
+		return ErrProtected.Error()
+	}
+	h := e.Hits[0]
+	return fmt.Sprintf("%v: %d blocks, first is block @ %08X in %q", ErrProtected, len(e.Hits), h.Block, h.Region)
+}
+
+func (e *ProtectedError) Unwrap() error {
+	return ErrProtected
+}
+
+// modelProtectedRegions lists protected regions of known phones, keyed by upper-case model name.
+// On both phones the firmware ends below 32 MB, EELITE and EEFULL are just below
+// and just above that address, and FFS takes the rest of flash. On C81 EELITE and
+// EEFULL are its two regions of small blocks. EL71 has only 256K blocks, so there
+// they are the whole blocks at the same addresses.
+var modelProtectedRegions = map[string][]ProtectedRegion{
+	"C81": {
+		{Name: "boot", Addr: 0, Size: 0x20000},
+		{Name: "eelite", Addr: 0x1FE0000, Size: 0x20000},
+		{Name: "eefull", Addr: 0x2000000, Size: 0x20000},
+		{Name: "ffs", Addr: 0x2020000, Size: 0x1FE0000},
+	},
+	"EL71": {
+		{Name: "boot", Addr: 0, Size: 0x40000},
+		{Name: "eelite", Addr: 0x1FC0000, Size: 0x40000},
+		{Name: "eefull", Addr: 0x2000000, Size: 0x40000},
+		{Name: "ffs", Addr: 0x2040000, Size: 0x1FC0000},
+	},
+}
+
+// DefaultProtectedRegions returns the regions to protect on flash with the layout bm:
+// the first erase block with the boot core ("boot"), and the regions of blocks smaller
+// than the rest, where EEPROM (EELITE and EEFULL) is kept ("eeprom").
+func DefaultProtectedRegions(bm blockman.Blockman) []ProtectedRegion {
+	g := bm.Geometry()
+	if len(g.Regions) == 0 {
+		return nil
+	}
+	regions := []ProtectedRegion{{Name: "boot", Addr: 0, Size: g.Regions[0].BlockSize}}
+
+	var maxBlock int64
+	for _, reg := range g.Regions {
+		if reg.BlockSize > maxBlock {
+			maxBlock = reg.BlockSize
+		}
+	}
+	var addr int64
+	for _, reg := range g.Regions {
+		size := reg.BlockSize * int64(reg.BlockCount)
+		if reg.BlockSize < maxBlock {
+			last := &regions[len(regions)-1]
+			if last.Name == "eeprom" && last.Addr+last.Size == addr {
+				last.Size += size
+			} else {
+				regions = append(regions, ProtectedRegion{Name: "eeprom", Addr: addr, Size: size})
+			}
+		}
+		addr += size
+	}
+	return regions
+}
+
+// LoadProtectedRegions reads protected regions of phone models from a JSON file like
+// {"C81": [{"name": "ffs", "addr": 25165824, "size": 8388608}]}.
+func LoadProtectedRegions(path string) (map[string][]ProtectedRegion, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var stored map[string][]ProtectedRegion
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("cannot parse protected regions %q: %v", path, err)
+	}
+	models := map[string][]ProtectedRegion{}
+	for model, regions := range stored {
+		for _, r := range regions {
+			if r.Name == "" || r.Size <= 0 {
+				return nil, fmt.Errorf("%s: invalid protected region %v", model, r)
+			}
+		}
+		models[strings.ToUpper(model)] = regions
+	}
+	return models, nil
+}
+
+// ProtectedRegions returns the regions to protect on the phone: the built-in ones of its
+// model or, for unknown models, DefaultProtectedRegions, and in addition the ones given
+// for its model in models.
+func ProtectedRegions(info pmb887x.ChaosPhoneInfo, models map[string][]ProtectedRegion) []ProtectedRegion {
+	model := strings.ToUpper(trimInfoString(info.ModelName))
+	regions, ok := modelProtectedRegions[model]
+	if !ok {
+		regions = DefaultProtectedRegions(info.BlockMap)
+	}
+	return append(append([]ProtectedRegion(nil), regions...), models[model]...)
+}
+
+// AllowRegions returns regions without the ones named in allowed.
+func AllowRegions(regions []ProtectedRegion, allowed []string) ([]ProtectedRegion, error) {
+	allow := map[string]bool{}
+	for _, name := range allowed {
+		if name == AllRegions {
+			return nil, nil
+		}
+		found := false
+		for _, r := range regions {
+			found = found || r.Name == name
+		}
+		if !found {
+			return nil, fmt.Errorf("no protected region %q, there are: %s", name, regionNames(regions))
+		}
+		allow[name] = true
+	}
+	var left []ProtectedRegion
+	for _, r := range regions {
+		if !allow[r.Name] {
+			left = append(left, r)
+		}
+	}
+	return left, nil
+}
+
+func regionNames(regions []ProtectedRegion) string {
+	var names []string
+	seen := map[string]bool{}
+	for _, r := range regions {
+		if !seen[r.Name] {
+			names = append(names, r.Name)
+			seen[r.Name] = true
+		}
+	}
+	return strings.Join(append(names, AllRegions), ", ")
+}
+
+// protectedHits returns the blocks that overlap protected regions.
+// Since a block is erased before it's written, all of it counts.
+func protectedHits(info pmb887x.ChaosPhoneInfo, blocks []*Block, regions []ProtectedRegion) []ProtectedHit {
+	var hits []ProtectedHit
+	for _, block := range blocks {
+		addr := block.Addr - info.BlockMap.BaseAddr()
+		for _, r := range regions {
+			if r.overlaps(addr, int64(len(block.Data))) {
+				hits = append(hits, ProtectedHit{Region: r.Name, Block: block.Addr})
+			}
+		}
+	}
+	return hits
+}
+
+// CheckProtected returns a ProtectedError if executing the plan would write over regions,
+// like Execute does, so that it can be checked before anything else is done, e.g. a backup
+// is saved. The blocks that already have the data are not written, so they don't count.
+func (p *Plan) CheckProtected(regions []ProtectedRegion) error {
+	var blocks []*Block
+	for _, block := range p.Blocks {
+		if block.Original == nil || block.Changed() {
+			blocks = append(blocks, block)
+		}
+	}
+	if hits := protectedHits(p.Info, blocks, regions); len(hits) > 0 {
+		return &ProtectedError{Hits: hits}
+	}
+	return nil
+}
+
+// ChunkHit is a patch chunk that would erase a protected region.
+type ChunkHit struct {
+	Patch  string
+	Chunk  int64 // Address of the chunk relative to the flash base, as in the patch.
+	Region string
+}
+
+// ChunkHits returns the chunks of patches that are in the erase blocks overlapping protected regions.
+func ChunkHits(info pmb887x.ChaosPhoneInfo, patches []NamedPatch, regions []ProtectedRegion, revert bool) []ChunkHit {
+	bm := info.BlockMap
+	var hits []ChunkHit
+	for _, p := range patches {
+		for _, chunk := range effectiveChunks(p.Patch, revert) {
+			if len(chunk.NewData) == 0 {
+				continue
+			}
+			first, _, err := bm.ParamsForAddr(bm.BaseAddr() + chunk.BaseAddr)
+			if err != nil {
+				continue
+			}
+			lastBlock, lastSize, err := bm.ParamsForAddr(bm.BaseAddr() + chunk.EndAddr() - 1)
+			if err != nil {
+				continue
+			}
+			for _, r := range regions {
+				if r.overlaps(first-bm.BaseAddr(), lastBlock+lastSize-first) {
+					hits = append(hits, ChunkHit{Patch: p.Name, Chunk: chunk.BaseAddr, Region: r.Name})
+				}
+			}
+		}
+	}
+	return hits
+}
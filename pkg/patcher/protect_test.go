@@ -0,0 +1,156 @@
+package patcher
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/blockman"
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+)
+
+func TestDefaultProtectedRegions(t *testing.T) {
+	got := DefaultProtectedRegions(blockman.BlockmapForC81())
+	want := []ProtectedRegion{
+		{Name: "boot", Addr: 0, Size: 0x20000},
+		// Both regions of small blocks.
+		{Name: "eeprom", Addr: 0x1FE0000, Size: 0x40000},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Got regions %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Region #%d is %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	// Flash with blocks of one size has no place for EEPROM we know of.
+	if got := DefaultProtectedRegions(blockman.BlockmapForEL71()); len(got) != 1 || got[0].Name != "boot" {
+		t.Errorf("Got regions %v, want only boot", got)
+	}
+}
+
+func TestProtectedRegionsFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "regions.json")
+	if err := os.WriteFile(path, []byte(`{"c81": [{"name": "ffs2", "addr": 4096, "size": 256}], "S75": [{"name": "ffs", "addr": 4096, "size": 256}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	models, err := LoadProtectedRegions(path)
+	if err != nil {
+		t.Fatalf("LoadProtectedRegions failed: %v", err)
+	}
+	loader := newMemLoader()
+	info, _ := loader.ReadInfo(context.Background())
+	names := func(regions []ProtectedRegion) string {
+		var names []string
+		for _, r := range regions {
+			names = append(names, r.Name)
+		}
+		return strings.Join(names, " ")
+	}
+
+	// The regions from the file are added to the built-in ones.
+	info.ModelName = "C81\x00"
+	if got, want := names(ProtectedRegions(info, models)), "boot eelite eefull ffs ffs2"; got != want {
+		t.Errorf("Got regions %q, want %q", got, want)
+	}
+	info.ModelName = "EL71"
+	if got, want := names(ProtectedRegions(info, models)), "boot eelite eefull ffs"; got != want {
+		t.Errorf("Got regions %q, want %q", got, want)
+	}
+	// For a model without built-in regions, they are added to the ones found from the flash layout.
+	info.ModelName = "S75"
+	if got, want := names(ProtectedRegions(info, models)), "boot ffs"; got != want {
+		t.Errorf("Got regions %q, want %q", got, want)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"C81": [{"name": "ffs"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadProtectedRegions(path); err == nil {
+		t.Errorf("Region without size is accepted")
+	}
+}
+
+func TestAllowRegions(t *testing.T) {
+	regions := DefaultProtectedRegions(blockman.BlockmapForC81())
+	left, err := AllowRegions(regions, []string{"boot"})
+	if err != nil || len(left) != 1 || left[0].Name != "eeprom" {
+		t.Errorf("Got %v, %v; want only eeprom", left, err)
+	}
+	if left, err := AllowRegions(regions, []string{AllRegions}); err != nil || len(left) != 0 {
+		t.Errorf("Got %v, %v; want nothing", left, err)
+	}
+	if _, err := AllowRegions(regions, []string{"bot"}); err == nil {
+		t.Errorf("Unknown region is accepted")
+	}
+}
+
+func TestExecuteProtected(t *testing.T) {
+	loader := newMemLoader()
+	info, _ := loader.ReadInfo(context.Background())
+	regions := DefaultProtectedRegions(info.BlockMap)
+	patches := []NamedPatch{
+		namedPatch(t, "boot.vkp", "10: FFFF 1234\n"),
+		namedPatch(t, "ok.vkp", "210: FFFF 5678\n"),
+	}
+	plan, err := PrepareMany(context.Background(), loader, patches, false)
+	if err != nil {
+		t.Fatalf("PrepareMany failed: %v", err)
+	}
+
+	hits := ChunkHits(info, patches, regions, false)
+	if len(hits) != 1 || hits[0] != (ChunkHit{Patch: "boot.vkp", Chunk: 0x10, Region: "boot"}) {
+		t.Errorf("Got chunk hits %v", hits)
+	}
+	// It's known before anything is done, e.g. a backup is saved.
+	if err := plan.CheckProtected(regions); !errors.Is(err, ErrProtected) {
+		t.Errorf("CheckProtected() = %v, want %v", err, ErrProtected)
+	}
+
+	// Neither dry run nor force writes over the boot block.
+	for _, opts := range []Options{{DryRun: true}, {Force: true}} {
+		opts.Protected = regions
+		_, err = Execute(context.Background(), loader, plan, opts)
+		var protErr *ProtectedError
+		if !errors.As(err, &protErr) || !errors.Is(err, ErrProtected) {
+			t.Fatalf("%+v: got %v, want ProtectedError", opts, err)
+		}
+		if len(protErr.Hits) != 1 || protErr.Hits[0] != (ProtectedHit{Region: "boot", Block: 0xA0000000}) {
+			t.Errorf("Got hits %v", protErr.Hits)
+		}
+	}
+	if len(loader.writes) != 0 {
+		t.Fatalf("Blocks written over protection: %X", loader.writes)
+	}
+
+	allowed, err := AllowRegions(regions, []string{"boot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Execute(context.Background(), loader, plan, Options{Protected: allowed}); err != nil {
+		t.Fatalf("Execute with boot allowed failed: %v", err)
+	}
+	if len(loader.writes) != 2 {
+		t.Errorf("Written %X, want 2 blocks", loader.writes)
+	}
+}
+
+func TestChunkHitsWholeBlock(t *testing.T) {
+	loader := newMemLoader()
+	info, _ := loader.ReadInfo(context.Background())
+	// The chunk itself is outside the region, but its block is erased.
+	regions := []ProtectedRegion{{Name: "ffs", Addr: 0x100, Size: 0x10}}
+	pr, err := patchreader.FromString("1F0: FF 00\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits := ChunkHits(info, []NamedPatch{{Name: "p", Patch: pr}}, regions, false)
+	if len(hits) != 1 || hits[0].Region != "ffs" {
+		t.Errorf("Got chunk hits %v", hits)
+	}
+}
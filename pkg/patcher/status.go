@@ -0,0 +1,89 @@
+package patcher
+
+import (
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+)
+
+// ChunkState tells how a patch chunk relates to the current flash contents.
+type ChunkState int
+
+const (
+	ChunkReady    ChunkState = iota // The expected data is there, the chunk can be applied (or reverted).
+	ChunkDone                       // The chunk is already applied (or reverted).
+	ChunkMismatch                   // The flash contains something else.
+	ChunkNoUndo                     // The chunk is not reverted because of "#pragma disable undo".
+)
+
+func (s ChunkState) String() string {
+	switch s {
+	case ChunkReady:
+		return "ready"
+	case ChunkDone:
+		return "already done"
+	case ChunkMismatch:
+		return "mismatch"
+	case ChunkNoUndo:
+		return "can't undo"
+	}
+	return "unknown"
+}
+
+// ChunkStatus is the state of one patch chunk in a Plan.
+type ChunkStatus struct {
+	Chunk patchreader.Chunk
+	State ChunkState
+	// Mismatches is the number of bytes that don't match.
+	Mismatches int
+}
+
+// ChunkStatuses returns the state of every chunk of pr, which the plan was prepared for.
+func (p *Plan) ChunkStatuses(pr *patchreader.PatchReader) []ChunkStatus {
+	blockMapper := p.Info.BlockMap
+	blocks := map[int64]*Block{}
+	for _, block := range p.Blocks {
+		blocks[block.Addr] = block
+	}
+	noUndo := map[int64]bool{}
+	for _, addr := range p.NoUndo {
+		noUndo[addr] = true
+	}
+
+	var statuses []ChunkStatus
+	for _, chunk := range pr.Chunks() {
+		status := ChunkStatus{Chunk: chunk, State: ChunkReady}
+		if noUndo[chunk.BaseAddr] {
+			status.State = ChunkNoUndo
+			statuses = append(statuses, status)
+			continue
+		}
+		for _, m := range p.Mismatches {
+			if m.Addr >= chunk.BaseAddr && m.Addr < chunk.EndAddr() {
+				status.Mismatches++
+			}
+		}
+
+		want := chunk.NewData
+		if p.Revert {
+			want = chunk.OldData
+		}
+		done := true
+		for addr := chunk.BaseAddr; addr < chunk.EndAddr() && done; addr++ {
+			blockAddr, _, err := blockMapper.ParamsForAddr(addr + blockMapper.BaseAddr())
+			block, ok := blocks[blockAddr]
+			if err != nil || !ok {
+				done = false
+				break
+			}
+			done = block.Original[blockMapper.BaseAddr()+addr-blockAddr] == want[addr-chunk.BaseAddr]
+		}
+
+		switch {
+		case done:
+			status.State = ChunkDone
+		case status.Mismatches > 0:
+			status.State = ChunkMismatch
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -0,0 +1,50 @@
+package patcher
+
+import (
+	"context"
+	"testing"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patchreader"
+)
+
+func TestChunkStatuses(t *testing.T) {
+	loader := newMemLoader()
+	// The first chunk is applied already, the second one can be applied,
+	// the third one finds something unexpected.
+	copy(loader.flash[0x10:], []byte{0x12, 0x34})
+	copy(loader.flash[0x30:], []byte{0x00})
+	pr, err := patchreader.FromString("10: FFFF 1234\n20: FF 56\n30: FF 78\n")
+	if err != nil {
+		t.Fatalf("Cannot parse patch: %v", err)
+	}
+	plan, err := Prepare(context.Background(), loader, pr, false)
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+
+	want := []ChunkState{ChunkDone, ChunkReady, ChunkMismatch}
+	statuses := plan.ChunkStatuses(pr)
+	if len(statuses) != len(want) {
+		t.Fatalf("Got %d statuses, want %d", len(statuses), len(want))
+	}
+	for i, status := range statuses {
+		if status.State != want[i] {
+			t.Errorf("Chunk @ %X: got %s, want %s", status.Chunk.BaseAddr, status.State, want[i])
+		}
+	}
+	if statuses[2].Mismatches != 1 {
+		t.Errorf("Got %d mismatches in the last chunk, want 1", statuses[2].Mismatches)
+	}
+
+	// On revert, "#pragma disable undo" chunks are reported as such.
+	pr, err = patchreader.FromString("#pragma disable undo\n10: FFFF 1234\n")
+	if err != nil {
+		t.Fatalf("Cannot parse patch: %v", err)
+	}
+	if plan, err = Prepare(context.Background(), loader, pr, true); err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	if statuses := plan.ChunkStatuses(pr); len(statuses) != 1 || statuses[0].State != ChunkNoUndo {
+		t.Errorf("Got %+v, want one chunk that can't be undone", statuses)
+	}
+}
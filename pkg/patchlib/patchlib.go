@@ -0,0 +1,295 @@
+// Package patchlib indexes a directory of VKP patches by the metadata in their comments.
+package patchlib
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/patcheskibabcom"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Patch is metadata of one VKP patch.
+type Patch struct {
+	// Path is the patch file. It is empty for patches fetched from patches.kibab.com.
+	Path     string
+	Name     string
+	Author   string
+	Version  string
+	Firmware string // Like "SL75v52".
+	// KibabID is the ID on patches.kibab.com, 0 if unknown.
+	KibabID int
+	// ConfigID is "id" from a "{p=... id=...}" tag of patches with settings.
+	ConfigID string
+	// Description is the rest of the header comments.
+	Description []string
+}
+
+// Title returns the name of the patch with its firmware, if known.
+func (p *Patch) Title() string {
+	if p.Firmware == "" {
+		return p.Name
+	}
+	return fmt.Sprintf("%s (%s)", p.Name, p.Firmware)
+}
+
+// Matches returns true if every word of query is found in the patch metadata, ignoring case.
+func (p *Patch) Matches(query string) bool {
+	text := strings.ToLower(strings.Join(append([]string{
+		p.Path, p.Name, p.Author, p.Version, p.Firmware, p.ConfigID, strconv.Itoa(p.KibabID),
+	}, p.Description...), "\n"))
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	kibabURLRe = regexp.MustCompile(`patches\.kibab\.com/\S*[?&]id=(\d+)`)
+	firmwareRe = regexp.MustCompile(`(?i)\b([a-z]{1,3}\d{2})[ _]?(?:v|sw|fw)[ _.]?(\d{2,3})\b`)
+	authorRe   = regexp.MustCompile(`(?i)^(?:authors?|autor|автор|\(c\)|©|copyright)\s*[:\-]?\s*(.+)$`)
+	versionRe  = regexp.MustCompile(`(?i)^(?:v|ver|version|версия)\s*[:.]?\s*(\d[\w.]*)$`)
+	tagRe      = regexp.MustCompile(`\{p=([^{}]*)\}`)
+	tagKeyRe   = regexp.MustCompile(`(?:^|\s)(\w+)=`)
+)
+
+// Decode converts the text of a patch to UTF-8. Patches that are not valid UTF-8
+// are assumed to be in Windows-1251, like most of them.
+func Decode(data []byte) string {
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	decoded, err := charmap.Windows1251.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data)
+	}
+	return string(decoded)
+}
+
+// headerComments returns the comment lines before the first line with data.
+func headerComments(text string) []string {
+	var lines []string
+	inComment := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if inComment {
+			if end := strings.Index(line, "*/"); end >= 0 {
+				line, inComment = line[:end], false
+			}
+			lines = append(lines, strings.TrimSpace(strings.TrimLeft(line, "*")))
+			continue
+		}
+		switch {
+		case line == "" || strings.HasPrefix(line, "#pragma"):
+		case strings.HasPrefix(line, ";"):
+			lines = append(lines, strings.TrimSpace(strings.TrimLeft(line, ";")))
+		case strings.HasPrefix(line, "//"):
+			lines = append(lines, strings.TrimSpace(strings.TrimLeft(line, "/")))
+		case strings.HasPrefix(line, "/*"):
+			line = line[2:]
+			if end := strings.Index(line, "*/"); end >= 0 {
+				line = line[:end]
+			} else {
+				inComment = true
+			}
+			lines = append(lines, strings.TrimSpace(line))
+		default:
+			return lines
+		}
+	}
+	return lines
+}
+
+// parseTag parses "name ver=2 cp=author id=AB15" from a "{p=...}" tag.
+// Values may contain spaces, so each one lasts until the next key.
+func parseTag(tag string) map[string]string {
+	values := map[string]string{}
+	keys := tagKeyRe.FindAllStringSubmatchIndex(tag, -1)
+	values["p"] = strings.TrimSpace(tag)
+	for i, k := range keys {
+		if i == 0 {
+			values["p"] = strings.TrimSpace(tag[:k[0]])
+		}
+		end := len(tag)
+		if i+1 < len(keys) {
+			end = keys[i+1][0]
+		}
+		values[tag[k[2]:k[3]]] = strings.TrimSpace(tag[k[1]:end])
+	}
+	return values
+}
+
+// ParseMetadata extracts metadata from the text of a patch.
+func ParseMetadata(text string) Patch {
+	var p Patch
+	for _, line := range headerComments(text) {
+		if line == "" {
+			continue
+		}
+		if m := kibabURLRe.FindStringSubmatch(line); m != nil {
+			if p.KibabID == 0 {
+				p.KibabID, _ = strconv.Atoi(m[1])
+			}
+			continue
+		}
+		if m := authorRe.FindStringSubmatch(line); m != nil && p.Author == "" {
+			p.Author = strings.TrimSpace(m[1])
+			continue
+		}
+		if m := versionRe.FindStringSubmatch(line); m != nil && p.Version == "" {
+			p.Version = m[1]
+			continue
+		}
+		if m := firmwareRe.FindStringSubmatchIndex(line); m != nil {
+			if p.Firmware == "" {
+				p.Firmware = strings.ToUpper(line[m[2]:m[3]]) + "v" + line[m[4]:m[5]]
+			}
+			// "SL75v52 Work without SIM card": the rest is the name.
+			line = strings.Trim(line[:m[0]]+" "+line[m[1]:], " -:;,.")
+			if line == "" {
+				continue
+			}
+		}
+		if p.Name == "" {
+			p.Name = line
+		} else {
+			p.Description = append(p.Description, line)
+		}
+	}
+
+	// Patches with settings have a "{p=Name ver=1 cp=Author id=ID}" tag in their data.
+	if m := tagRe.FindStringSubmatch(text); m != nil {
+		tag := parseTag(m[1])
+		if tag["p"] != "" {
+			if p.Name != "" {
+				p.Description = append([]string{p.Name}, p.Description...)
+			}
+			p.Name = tag["p"]
+		}
+		if p.Author == "" {
+			p.Author = tag["cp"]
+		}
+		if p.Version == "" {
+			p.Version = tag["ver"]
+		}
+		p.ConfigID = tag["id"]
+	}
+	return p
+}
+
+// Load reads metadata of the patch at path.
+func Load(path string) (Patch, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Patch{}, err
+	}
+	p := ParseMetadata(Decode(data))
+	p.Path = path
+	if p.Name == "" {
+		p.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return p, nil
+}
+
+// FetchKibab fetches a patch from patches.kibab.com and returns its metadata and
+// text as downloaded, without converting it to UTF-8.
+func FetchKibab(id int) (Patch, string, error) {
+	text, err := patcheskibabcom.PatchByID(id)
+	if err != nil {
+		return Patch{}, "", err
+	}
+	p := ParseMetadata(Decode([]byte(text)))
+	p.KibabID = id
+	if p.Name == "" {
+		p.Name = fmt.Sprintf("patches.kibab.com #%d", id)
+	}
+	return p, text, nil
+}
+
+// Library is a directory with VKP patches, including subdirectories.
+type Library struct {
+	Dir string
+	// Patches are sorted by firmware and name.
+	Patches []*Patch
+}
+
+// Open indexes all *.vkp files in dir.
+func Open(dir string) (*Library, error) {
+	lib := &Library{Dir: dir}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".vkp") {
+			return nil
+		}
+		p, err := Load(path)
+		if err != nil {
+			return fmt.Errorf("cannot read patch: %w", err)
+		}
+		lib.Patches = append(lib.Patches, &p)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot index patches in %q: %w", dir, err)
+	}
+	sort.SliceStable(lib.Patches, func(i, j int) bool {
+		a, b := lib.Patches[i], lib.Patches[j]
+		if !strings.EqualFold(a.Firmware, b.Firmware) {
+			return strings.ToLower(a.Firmware) < strings.ToLower(b.Firmware)
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+	return lib, nil
+}
+
+// RelPath returns the path of p relative to the library directory.
+func (l *Library) RelPath(p *Patch) string {
+	if rel, err := filepath.Rel(l.Dir, p.Path); err == nil {
+		return rel
+	}
+	return p.Path
+}
+
+// Search returns patches matching query (see Patch.Matches) for firmware.
+// Empty query or firmware match everything.
+func (l *Library) Search(query, firmware string) []*Patch {
+	var found []*Patch
+	for _, p := range l.Patches {
+		if firmware != "" && !strings.EqualFold(p.Firmware, firmware) {
+			continue
+		}
+		if p.Matches(query) {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+// Find returns the patch with patches.kibab.com ID ref if ref is a number,
+// or the patch at path ref (absolute or relative to the library).
+func (l *Library) Find(ref string) (*Patch, bool) {
+	if id, err := strconv.Atoi(ref); err == nil {
+		for _, p := range l.Patches {
+			if p.KibabID == id {
+				return p, true
+			}
+		}
+		return nil, false
+	}
+	for _, p := range l.Patches {
+		if p.Path == ref || l.RelPath(p) == filepath.Clean(ref) {
+			return p, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,133 @@
+package patchlib
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestParseMetadata(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want Patch
+	}{
+		{
+			name: "header comments",
+			text: `;SL75v52 Work without SIM card
+;(c) Chaos
+;v. 1.1
+;Allows to use the phone without a SIM card.
+;Details: https://patches.kibab.com/patches/details.php5?id=1234
++A0000000
+#pragma enable old_equal_ff
+0012345: 00 01
+; Not a header comment.
+`,
+			want: Patch{Name: "Work without SIM card", Author: "Chaos", Version: "1.1", Firmware: "SL75v52", KibabID: 1234,
+				Description: []string{"Allows to use the phone without a SIM card."}},
+		},
+		{
+			name: "firmware on its own line and C comments",
+			text: `/* EL71 sw45
+   Big clock
+   Author: somebody */
+0012345: 00 01
+`,
+			want: Patch{Name: "Big clock", Author: "somebody", Firmware: "EL71v45"},
+		},
+		{
+			name: "settings tag",
+			text: `; Screenshots
+0FC73F0: E4D3C2B1,0x0000AB15,"blabla\
+{p=Screen Shooter ver=2 cp=avkiev id=AB15}\
+",00
+`,
+			want: Patch{Name: "Screen Shooter", Author: "avkiev", Version: "2", ConfigID: "AB15", Description: []string{"Screenshots"}},
+		},
+		{
+			name: "no metadata",
+			text: "0012345: 00 01\n",
+			want: Patch{},
+		},
+	}
+	for _, tc := range tests {
+		got := ParseMetadata(tc.text)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: ParseMetadata() = %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseMetadataFromTestdata(t *testing.T) {
+	p, err := Load(filepath.Join("..", "..", "testdata", "string_data.vkp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.KibabID != 5445 || p.Name != "ScreenShooter" || p.Author != "avkiev" || p.ConfigID != "AB15" {
+		t.Errorf("Load() = %+v", p)
+	}
+}
+
+func TestLibrary(t *testing.T) {
+	dir := t.TempDir()
+	cp1251, err := charmap.Windows1251.NewEncoder().String(";CX75v25 Часы\n;(c) Автор\n0012345: 00 01\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"SL75/nosim.vkp":  ";SL75v52 Work without SIM card\n;Details: https://patches.kibab.com/patches/details.php5?id=1234\n0012345: 00 01\n",
+		"SL75/clock.VKP":  ";SL75v52 Big clock\n0012345: 00 01\n",
+		"CX75/clock.vkp":  cp1251,
+		"CX75/noname.vkp": "0012345: 00 01\n",
+		"readme.txt":      "Not a patch",
+	}
+	for name, text := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lib, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+	var names []string
+	for _, p := range lib.Patches {
+		names = append(names, p.Title())
+	}
+	wantNames := []string{"noname", "Часы (CX75v25)", "Big clock (SL75v52)", "Work without SIM card (SL75v52)"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("Patches = %q, want %q", names, wantNames)
+	}
+	if lib.Patches[1].Author != "Автор" {
+		t.Errorf("Author of a CP1251 patch = %q", lib.Patches[1].Author)
+	}
+
+	if got := lib.Search("clock", "sl75V52"); len(got) != 1 || got[0].Name != "Big clock" {
+		t.Errorf("Search(clock, SL75v52) = %v", got)
+	}
+	if got := lib.Search("часы автор", ""); len(got) != 1 {
+		t.Errorf("Search(часы автор) = %v", got)
+	}
+	if got := lib.Search("", "SL75v52"); len(got) != 2 {
+		t.Errorf("Search(\"\", SL75v52) = %v", got)
+	}
+
+	if p, ok := lib.Find("1234"); !ok || p.Name != "Work without SIM card" {
+		t.Errorf("Find(1234) = %v, %v", p, ok)
+	}
+	if p, ok := lib.Find(filepath.Join("SL75", "clock.VKP")); !ok || p.Name != "Big clock" {
+		t.Errorf("Find(SL75/clock.VKP) = %v, %v", p, ok)
+	}
+	if _, ok := lib.Find("4321"); ok {
+		t.Errorf("Find(4321) found a patch")
+	}
+}
@@ -21,6 +21,33 @@ type Chunk struct {
 	BaseAddr int64
 	OldData  []byte
 	NewData  []byte
+	// Pragmas that were in effect when the chunk was defined.
+	Pragmas Pragmas
+}
+
+// Pragmas hold the settings controlled by #pragma statements.
+type Pragmas struct {
+	// OldEqualFF: old data is not given in the patch and assumed to be all 0xFF.
+	OldEqualFF bool
+	// Undo: the chunk can be reverted.
+	Undo bool
+	// WarnNoOldOnApply: complain if the old data is not found when applying.
+	WarnNoOldOnApply bool
+	// WarnIfNewExistOnApply: complain if the new data is already there when applying.
+	WarnIfNewExistOnApply bool
+	// WarnIfOldExistOnUndo: complain if the old data is already there when reverting.
+	WarnIfOldExistOnUndo bool
+}
+
+// DefaultPragmas returns the settings in effect at the beginning of a patch, like in V_Klay.
+func DefaultPragmas() Pragmas {
+	return Pragmas{
+		OldEqualFF:            false,
+		Undo:                  true,
+		WarnNoOldOnApply:      true,
+		WarnIfNewExistOnApply: true,
+		WarnIfOldExistOnUndo:  true,
+	}
 }
 
 func (c *Chunk) Size() int64 {
@@ -180,8 +207,8 @@ func parseDataField(df string) ([]byte, error) {
 }
 
 type chunkSettings struct {
-	isOldEqualFF bool
-	addrOffset   int64
+	pragmas    Pragmas
+	addrOffset int64
 }
 
 // parsePragma recognizes #pragma statements which can change
@@ -190,10 +217,10 @@ type chunkSettings struct {
 // #pragma enable old_equal_ff
 // Supported pragmas:
 // * old_equal_ff
-// Unsupported pragmas:
 // * undo
 // * warn_if_new_exist_on_apply
 // * warn_no_old_on_apply
+// * warn_if_old_exist_on_undo
 func parsePragma(currentSettings *chunkSettings, pragmaStr string) error {
 	pragmaPos := strings.Index(pragmaStr, PragmaMarker)
 	if pragmaPos == -1 {
@@ -213,9 +240,15 @@ func parsePragma(currentSettings *chunkSettings, pragmaStr string) error {
 	}
 	switch pragma[1] {
 	case "old_equal_ff":
-		currentSettings.isOldEqualFF = pragmaEnable
+		currentSettings.pragmas.OldEqualFF = pragmaEnable
+	case "undo":
+		currentSettings.pragmas.Undo = pragmaEnable
+	case "warn_no_old_on_apply":
+		currentSettings.pragmas.WarnNoOldOnApply = pragmaEnable
+	case "warn_if_new_exist_on_apply":
+		currentSettings.pragmas.WarnIfNewExistOnApply = pragmaEnable
 	case "warn_if_old_exist_on_undo":
-		fmt.Printf("pragma warn_if_old_exist_on_undo -- ignoring\n")
+		currentSettings.pragmas.WarnIfOldExistOnUndo = pragmaEnable
 	default:
 		return fmt.Errorf("unrecognized pragma %q", pragma[1])
 	}
@@ -266,7 +299,7 @@ func (pr *PatchReader) parse() error {
 
 	lineNum := 0
 	var currentAddr int64 = 0
-	var currentSettings chunkSettings
+	currentSettings := chunkSettings{pragmas: DefaultPragmas()}
 
 	for scanner.Scan() {
 		lineNum++
@@ -314,7 +347,7 @@ func (pr *PatchReader) parse() error {
 
 		var oldData []byte
 		var newDataStr string
-		if !currentSettings.isOldEqualFF {
+		if !currentSettings.pragmas.OldEqualFF {
 			if len(dataFields) != 2 {
 				return fmt.Errorf("line %d: cannot split string %q into data information", lineNum, dataInfo)
 			}
@@ -335,7 +368,7 @@ func (pr *PatchReader) parse() error {
 			return fmt.Errorf("line %d: cannot parse new data (%q): %v", lineNum, newDataStr, err)
 		}
 
-		if currentSettings.isOldEqualFF {
+		if currentSettings.pragmas.OldEqualFF {
 			oldData = make([]byte, len(newData))
 			for i := 0; i < len(newData); i++ {
 				oldData[i] = 0xFF
@@ -350,8 +383,8 @@ func (pr *PatchReader) parse() error {
 		// Now, if this line is describing a continuos block of data together with the previous line,
 		// just extend the previous line.
 		// If this line describes the changes at an address that doesn't follow immediately after the prev line,
-		// create a new chunk.
-		if currentAddr == addr && len(pr.chunks) != 0 {
+		// or different pragmas are in effect, create a new chunk.
+		if currentAddr == addr && len(pr.chunks) != 0 && pr.chunks[len(pr.chunks)-1].Pragmas == currentSettings.pragmas {
 			lastChunk := &pr.chunks[len(pr.chunks)-1]
 			lastChunk.OldData = append(lastChunk.OldData, oldData...)
 			lastChunk.NewData = append(lastChunk.NewData, newData...)
@@ -360,6 +393,7 @@ func (pr *PatchReader) parse() error {
 			newChunk.BaseAddr = addr
 			newChunk.OldData = oldData
 			newChunk.NewData = newData
+			newChunk.Pragmas = currentSettings.pragmas
 			pr.chunks = append(pr.chunks, newChunk)
 			currentAddr = addr
 		}
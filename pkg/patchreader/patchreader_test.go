@@ -97,6 +97,26 @@ func TestParsePragma(t *testing.T) {
 			pragmaStr: "#pragma disalbe old_equal_ff",
 			wantError: true,
 		},
+		{
+			pragmaStr: "#pragma disable undo",
+			wantError: false,
+		},
+		{
+			pragmaStr: "#pragma disable warn_no_old_on_apply",
+			wantError: false,
+		},
+		{
+			pragmaStr: "#pragma enable warn_if_new_exist_on_apply",
+			wantError: false,
+		},
+		{
+			pragmaStr: "#pragma disable warn_if_old_exist_on_undo",
+			wantError: false,
+		},
+		{
+			pragmaStr: "#pragma enable no_such_pragma",
+			wantError: true,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -109,6 +129,27 @@ func TestParsePragma(t *testing.T) {
 	}
 }
 
+func TestPragmasInChunks(t *testing.T) {
+	p, err := FromFile(testFileFullPath("pragmas.vkp"))
+	if err != nil {
+		t.Fatalf("Cannot load patch: %v", err)
+	}
+	wantPragmas := []Pragmas{DefaultPragmas(), DefaultPragmas(), DefaultPragmas()}
+	wantPragmas[1].Undo = false
+	wantPragmas[1].WarnNoOldOnApply = false
+	wantPragmas[2].WarnIfNewExistOnApply = false
+	wantPragmas[2].WarnIfOldExistOnUndo = false
+
+	if p.NumChunks() != len(wantPragmas) {
+		t.Fatalf("Got %d chunks, want %d", p.NumChunks(), len(wantPragmas))
+	}
+	for i, chunk := range p.Chunks() {
+		if chunk.Pragmas != wantPragmas[i] {
+			t.Errorf("Chunk #%d: got pragmas %+v, want %+v", i, chunk.Pragmas, wantPragmas[i])
+		}
+	}
+}
+
 func TestParseDataField(t *testing.T) {
 	testCases := []struct {
 		descr           string
@@ -0,0 +1,136 @@
+package patchreader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// DefaultBytesPerLine is how many bytes of new data go into one VKP line by default.
+	DefaultBytesPerLine = 16
+)
+
+// WriteOptions control how chunks are serialized into VKP text.
+type WriteOptions struct {
+	// BytesPerLine limits the amount of data on one line. DefaultBytesPerLine is used if 0.
+	BytesPerLine int
+	// AddrOffset, if not 0, is emitted as "+offset" before the patch body,
+	// and all addresses are written relative to it.
+	AddrOffset int64
+	// Header is written as comment lines at the top of the patch.
+	Header string
+}
+
+// Reverted returns a chunk that undoes c.
+func (c Chunk) Reverted() Chunk {
+	rev := Chunk{
+		BaseAddr: c.BaseAddr,
+		OldData:  append([]byte{}, c.NewData...),
+		NewData:  append([]byte{}, c.OldData[:len(c.NewData)]...),
+		Pragmas:  c.Pragmas,
+	}
+	// Old data is now given explicitly.
+	rev.Pragmas.OldEqualFF = false
+	return rev
+}
+
+// RevertChunks returns chunks that undo the given ones.
+func RevertChunks(chunks []Chunk) []Chunk {
+	rev := make([]Chunk, len(chunks))
+	for i, c := range chunks {
+		rev[i] = c.Reverted()
+	}
+	return rev
+}
+
+// writePragmaChanges emits #pragma lines for every setting that differs between cur and want.
+func writePragmaChanges(w *bufio.Writer, cur, want Pragmas) {
+	pragmas := []struct {
+		name      string
+		cur, want bool
+	}{
+		{"old_equal_ff", cur.OldEqualFF, want.OldEqualFF},
+		{"undo", cur.Undo, want.Undo},
+		{"warn_no_old_on_apply", cur.WarnNoOldOnApply, want.WarnNoOldOnApply},
+		{"warn_if_new_exist_on_apply", cur.WarnIfNewExistOnApply, want.WarnIfNewExistOnApply},
+		{"warn_if_old_exist_on_undo", cur.WarnIfOldExistOnUndo, want.WarnIfOldExistOnUndo},
+	}
+	for _, p := range pragmas {
+		if p.cur == p.want {
+			continue
+		}
+		state := "disable"
+		if p.want {
+			state = "enable"
+		}
+		fmt.Fprintf(w, "%s %s %s\n", PragmaMarker, state, p.name)
+	}
+}
+
+// isAllFF returns true if every byte in data is 0xFF.
+func isAllFF(data []byte) bool {
+	for _, b := range data {
+		if b != 0xFF {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteVKP serializes chunks into VKP text.
+func WriteVKP(out io.Writer, chunks []Chunk, opts WriteOptions) error {
+	bytesPerLine := opts.BytesPerLine
+	if bytesPerLine <= 0 {
+		bytesPerLine = DefaultBytesPerLine
+	}
+
+	w := bufio.NewWriter(out)
+	if opts.Header != "" {
+		for _, line := range strings.Split(strings.TrimRight(opts.Header, "\n"), "\n") {
+			fmt.Fprintf(w, "%c %s\n", CommentMarker, line)
+		}
+	}
+	if opts.AddrOffset != 0 {
+		fmt.Fprintf(w, "+%X\n", opts.AddrOffset)
+	}
+
+	cur := DefaultPragmas()
+	for _, chunk := range chunks {
+		if chunk.BaseAddr < opts.AddrOffset {
+			return fmt.Errorf("chunk @ %X is below the address offset %X", chunk.BaseAddr, opts.AddrOffset)
+		}
+		if len(chunk.OldData) < len(chunk.NewData) {
+			return fmt.Errorf("chunk @ %X: old data length (%d) smaller than new data length (%d)", chunk.BaseAddr, len(chunk.OldData), len(chunk.NewData))
+		}
+		if chunk.Pragmas.OldEqualFF && !isAllFF(chunk.OldData) {
+			return fmt.Errorf("chunk @ %X has old_equal_ff enabled, but its old data is not all FF", chunk.BaseAddr)
+		}
+		writePragmaChanges(w, cur, chunk.Pragmas)
+		cur = chunk.Pragmas
+
+		for off := 0; off < len(chunk.NewData); off += bytesPerLine {
+			end := off + bytesPerLine
+			if end > len(chunk.NewData) {
+				end = len(chunk.NewData)
+			}
+			oldEnd := end
+			if end == len(chunk.NewData) {
+				// Extra old data goes to the last line.
+				oldEnd = len(chunk.OldData)
+			}
+			addr := chunk.BaseAddr + int64(off) - opts.AddrOffset
+			if cur.OldEqualFF {
+				fmt.Fprintf(w, "%07X: %X\n", addr, chunk.NewData[off:end])
+			} else {
+				fmt.Fprintf(w, "%07X: %X %X\n", addr, chunk.OldData[off:oldEnd], chunk.NewData[off:end])
+			}
+		}
+	}
+	writePragmaChanges(w, cur, DefaultPragmas())
+	if opts.AddrOffset != 0 {
+		fmt.Fprintln(w, "+0")
+	}
+	return w.Flush()
+}
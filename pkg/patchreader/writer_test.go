@@ -0,0 +1,66 @@
+package patchreader
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteVKPRoundTrip(t *testing.T) {
+	fileNames := []string{
+		"plainbody.vkp",
+		"onebigchunk.vkp",
+		"pragma_old_equal_ff.vkp",
+		"addr_offset.vkp",
+		"comma_separated_data.vkp",
+		"ints_in_data.vkp",
+		"more_old_than_new.vkp",
+		"pragmas.vkp",
+	}
+	optsList := []WriteOptions{
+		{},
+		{BytesPerLine: 3, Header: "Generated\nby a test"},
+		{AddrOffset: 0x10},
+	}
+
+	for _, fileName := range fileNames {
+		p, err := FromFile(testFileFullPath(fileName))
+		if err != nil {
+			t.Fatalf("Test %q: cannot load patch: %v", fileName, err)
+		}
+		for _, opts := range optsList {
+			var sb strings.Builder
+			if err := WriteVKP(&sb, p.Chunks(), opts); err != nil {
+				t.Fatalf("Test %q, %+v: cannot write patch: %v", fileName, opts, err)
+			}
+			p2, err := FromString(sb.String())
+			if err != nil {
+				t.Fatalf("Test %q, %+v: cannot parse written patch: %v\n%s", fileName, opts, err, sb.String())
+			}
+			if !reflect.DeepEqual(p.Chunks(), p2.Chunks()) {
+				t.Errorf("Test %q, %+v: chunks differ after round trip:\n%s", fileName, opts, sb.String())
+			}
+		}
+	}
+}
+
+func TestRevertChunks(t *testing.T) {
+	p, err := FromFile(testFileFullPath("pragma_old_equal_ff.vkp"))
+	if err != nil {
+		t.Fatalf("Cannot load patch: %v", err)
+	}
+	var sb strings.Builder
+	if err := WriteVKP(&sb, RevertChunks(p.Chunks()), WriteOptions{}); err != nil {
+		t.Fatalf("Cannot write revert patch: %v", err)
+	}
+	rev, err := FromString(sb.String())
+	if err != nil {
+		t.Fatalf("Cannot parse revert patch: %v\n%s", err, sb.String())
+	}
+	for i, chunk := range rev.Chunks() {
+		orig := p.Chunks()[i]
+		if !reflect.DeepEqual(chunk.OldData, orig.NewData) || !reflect.DeepEqual(chunk.NewData, orig.OldData) {
+			t.Errorf("Chunk #%d is not reverted:\n%s", i, sb.String())
+		}
+	}
+}
@@ -2,10 +2,13 @@ package pmb887x
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/blockman"
 )
@@ -58,11 +61,16 @@ type ChaosPhoneInfo struct {
 	Manufacturer string
 	IMEI         string
 	BlockMap     blockman.Blockman
+	FlashChip    FlashChipInfo
+	Reserved0    [16]byte
+	Reserved1    [12]byte
+	// RawInfo is the raw reply to "info" command this information was parsed from.
+	RawInfo []byte
 }
 
 // String implements fmt.Stringer.
 func (i ChaosPhoneInfo) String() string {
-	return fmt.Sprintf("Model %s by %s, IMEI %s\nFlash map:\n%s", i.ModelName, i.Manufacturer, i.IMEI, i.BlockMap)
+	return fmt.Sprintf("Model %s by %s, IMEI %s\nFlash chip: %s\nFlash map:\n%s", i.ModelName, i.Manufacturer, i.IMEI, i.FlashChip, i.BlockMap)
 }
 
 // chaosInfo describes the on-the-wire format of reply to "info" command.
@@ -101,27 +109,76 @@ type readWriteCmd struct {
 type ChaosLoader struct {
 	pmb Device
 	bm  *blockman.Blockman
+
+	// If verifyWrites is set, every written block is read back and compared.
+	verifyWrites  bool
+	verifyRetries int
+
+	// commandDelay is waited before sending every command.
+	commandDelay time.Duration
+}
+
+// speedSwitchDelay is how long the phone needs to switch to a new speed.
+// It doesn't tell us when it's done, so we have to wait.
+const speedSwitchDelay = 100 * time.Millisecond
+
+// VerifyError is returned by WriteFlash when some blocks still have wrong
+// contents after all retries.
+type VerifyError struct {
+	BadBlocks []int64
+}
+
+func (e *VerifyError) Error() string {
+	addrs := make([]string, len(e.BadBlocks))
+	for i, addr := range e.BadBlocks {
+		addrs[i] = fmt.Sprintf("0x%08X", addr)
+	}
+	return fmt.Sprintf("verification failed for %d blocks: %s", len(e.BadBlocks), strings.Join(addrs, ", "))
 }
 
 func ChaosControllerForDevice(dev Device) *ChaosLoader {
 	return &ChaosLoader{pmb: dev}
 }
 
-func (cl *ChaosLoader) Activate() error {
+// SetVerify enables or disables reading back every block written by WriteFlash.
+// A block that doesn't match is erased and written again up to retries times.
+func (cl *ChaosLoader) SetVerify(enabled bool, retries int) {
+	cl.verifyWrites = enabled
+	cl.verifyRetries = retries
+}
+
+// SetCommandDelay makes the loader wait before sending every command.
+// Normally replies are awaited without any delays, but some flaky USB-serial
+// adapters lose data unless the line is quiet for a while (100ms used to be the default).
+func (cl *ChaosLoader) SetCommandDelay(d time.Duration) {
+	cl.commandDelay = d
+}
+
+// pace waits before sending the next command, see SetCommandDelay.
+// If the previous command was abandoned, the rest of its reply is discarded first.
+func (cl *ChaosLoader) pace(ctx context.Context) error {
+	if err := cl.pmb.drain(ctx); err != nil {
+		return err
+	}
+	return sleep(ctx, cl.commandDelay)
+}
+
+func (cl *ChaosLoader) Activate(ctx context.Context) error {
 	// We need to get an ACK that Chaos boot loaded: 0xA5
+	stepCtx, cancel := cl.pmb.stepContext(ctx, cl.pmb.timeouts.Reply, 0)
+	defer cancel()
 	r := []byte{0x0}
-	if _, err := cl.pmb.iostream.Read(r); err != nil {
-		return fmt.Errorf("error reading chaos loader ready message: %v", err)
+	if _, err := cl.pmb.read(stepCtx, r); err != nil {
+		return fmt.Errorf("error reading chaos loader ready message: %w", err)
 	}
 	if r[0] != 0xA5 {
 		return fmt.Errorf("unknown chaos loader ready message %X", r[0])
 	}
-	shortDelay()
 
 	// We need to send one ping to activate loader.
-	pong, err := cl.Ping()
+	pong, err := cl.Ping(ctx)
 	if err != nil {
-		return fmt.Errorf("error sending first ping: %v", err)
+		return fmt.Errorf("error sending first ping: %w", err)
 	}
 	if !pong {
 		return fmt.Errorf("chaos didn't reply to the first ping")
@@ -130,13 +187,17 @@ func (cl *ChaosLoader) Activate() error {
 	return nil
 }
 
-func (cl *ChaosLoader) Ping() (bool, error) {
-	if _, err := cl.pmb.iostream.Write([]byte{'A'}); err != nil {
+func (cl *ChaosLoader) Ping(ctx context.Context) (bool, error) {
+	if err := cl.pace(ctx); err != nil {
+		return false, err
+	}
+	ctx, cancel := cl.pmb.stepContext(ctx, cl.pmb.timeouts.Reply, 0)
+	defer cancel()
+	if _, err := cl.pmb.write(ctx, []byte{'A'}); err != nil {
 		return false, err
 	}
-	shortDelay()
 	reply := []byte{0x00}
-	if _, err := cl.pmb.iostream.Read(reply); err != nil {
+	if _, err := cl.pmb.read(ctx, reply); err != nil {
 		return false, err
 	}
 	if reply[0] == 'R' {
@@ -148,7 +209,7 @@ func (cl *ChaosLoader) Ping() (bool, error) {
 
 type SpeedSetterFunc func() error
 
-func (cl *ChaosLoader) SetSpeed(speed int, speedSetter SpeedSetterFunc) error {
+func (cl *ChaosLoader) SetSpeed(ctx context.Context, speed int, speedSetter SpeedSetterFunc) error {
 	chaosSpeeds := map[int]int{
 		115200:  0x01,
 		230400:  0x02,
@@ -165,13 +226,17 @@ func (cl *ChaosLoader) SetSpeed(speed int, speedSetter SpeedSetterFunc) error {
 	if !ok {
 		return fmt.Errorf("bootloader doesn't support speed %d", speed)
 	}
+	if err := cl.pace(ctx); err != nil {
+		return err
+	}
+	ctx, cancel := cl.pmb.stepContext(ctx, 2*cl.pmb.timeouts.Reply+speedSwitchDelay, 0)
+	defer cancel()
 	cmd := []byte{'H', byte(chaosReqSpeed)}
-	shortDelay()
-	if _, err := cl.pmb.iostream.Write(cmd); err != nil {
+	if _, err := cl.pmb.write(ctx, cmd); err != nil {
 		return err
 	}
 	reply := []byte{0x00}
-	if _, err := cl.pmb.iostream.Read(reply); err != nil {
+	if _, err := cl.pmb.read(ctx, reply); err != nil {
 		return err
 	}
 	if reply[0] != 0x68 {
@@ -180,11 +245,13 @@ func (cl *ChaosLoader) SetSpeed(speed int, speedSetter SpeedSetterFunc) error {
 	if err := speedSetter(); err != nil {
 		return fmt.Errorf("cannot set speed on our side of connection: %v", err)
 	}
-	shortDelay()
-	if _, err := cl.pmb.iostream.Write([]byte{'A'}); err != nil {
+	if err := sleep(ctx, speedSwitchDelay); err != nil {
+		return err
+	}
+	if _, err := cl.pmb.write(ctx, []byte{'A'}); err != nil {
 		return fmt.Errorf("cannot request connection verification after changing our speed: %w", err)
 	}
-	if _, err := cl.pmb.iostream.Read(reply); err != nil {
+	if _, err := cl.pmb.read(ctx, reply); err != nil {
 		return fmt.Errorf("cannot receive confirmation after changing our speed: %w", err)
 	}
 	if reply[0] != 0x48 {
@@ -194,20 +261,18 @@ func (cl *ChaosLoader) SetSpeed(speed int, speedSetter SpeedSetterFunc) error {
 }
 
 // ReadInfo sends "Get info" command to the bootloader and dumps the result.
-func (cl *ChaosLoader) ReadInfo() (ChaosPhoneInfo, error) {
-	shortDelay()
-	if _, err := cl.pmb.iostream.Write([]byte{'I'}); err != nil {
+func (cl *ChaosLoader) ReadInfo(ctx context.Context) (ChaosPhoneInfo, error) {
+	if err := cl.pace(ctx); err != nil {
 		return ChaosPhoneInfo{}, err
 	}
-	shortDelay()
-	reply := make([]byte, 128)
-	var n int
-	var err error
-	if n, err = io.ReadAtLeast(cl.pmb.iostream, reply, 128); err != nil {
+	ctx, cancel := cl.pmb.stepContext(ctx, cl.pmb.timeouts.Reply, 128)
+	defer cancel()
+	if _, err := cl.pmb.write(ctx, []byte{'I'}); err != nil {
 		return ChaosPhoneInfo{}, err
 	}
-	if n < 128 {
-		return ChaosPhoneInfo{}, fmt.Errorf("less than 128 bytes read: %d", n)
+	reply := make([]byte, 128)
+	if err := cl.pmb.readFull(ctx, reply); err != nil {
+		return ChaosPhoneInfo{}, fmt.Errorf("cannot read reply to info command: %w", err)
 	}
 
 	info, err := ParseChaosInfo(bytes.NewBuffer(reply))
@@ -219,22 +284,27 @@ func (cl *ChaosLoader) ReadInfo() (ChaosPhoneInfo, error) {
 	return info, nil
 }
 
-func (cl *ChaosLoader) readAndCheck(maxN int) ([]byte, error) {
+func (cl *ChaosLoader) readAndCheck(ctx context.Context, maxN int) ([]byte, error) {
 	// This is max what we could ever read, but the actual read amount will likely
 	// be smaller.
 	replyBuf := make([]byte, maxN)
 	var n int
 	var err error
-	if n, err = cl.pmb.iostream.Read(replyBuf); err != nil {
-		return nil, fmt.Errorf("cannot read flash: %v", err)
+	if n, err = cl.pmb.read(ctx, replyBuf); err != nil {
+		return nil, fmt.Errorf("cannot read flash: %w", err)
 	}
 	return replyBuf[:n], nil
 }
 
 // ReadFlash reads a memory region from Flash.
-func (cl *ChaosLoader) ReadFlash(baseAddr int64, buf []byte) error {
+func (cl *ChaosLoader) ReadFlash(ctx context.Context, baseAddr int64, buf []byte) error {
+	return cl.readFlash(ctx, baseAddr, buf, PhaseReading)
+}
+
+// readFlash reads a memory region from Flash reporting progress as phase.
+func (cl *ChaosLoader) readFlash(ctx context.Context, baseAddr int64, buf []byte, phase Phase) error {
 	if cl.bm == nil {
-		if _, err := cl.ReadInfo(); err != nil {
+		if _, err := cl.ReadInfo(ctx); err != nil {
 			return err
 		}
 	}
@@ -253,22 +323,31 @@ func (cl *ChaosLoader) ReadFlash(baseAddr int64, buf []byte) error {
 		fmt.Println("binary.Write failed:", err)
 	}
 
-	shortDelay()
-	if _, err := cl.pmb.iostream.Write(cmdBuf.Bytes()); err != nil {
+	if err := cl.pace(ctx); err != nil {
+		return err
+	}
+	ctx, cancel := cl.pmb.stepContext(ctx, cl.pmb.timeouts.Reply, reqLen)
+	defer cancel()
+	if _, err := cl.pmb.write(ctx, cmdBuf.Bytes()); err != nil {
 		return err
 	}
-	shortDelay()
 
 	// We need the total length + 4 bytes control data.
+	started := time.Now()
 	stillNeedToRead := reqLen + 4
 	inBuffer := make([]byte, 0, stillNeedToRead)
 	for stillNeedToRead > 0 {
-		gotData, err := cl.readAndCheck(stillNeedToRead)
+		gotData, err := cl.readAndCheck(ctx, stillNeedToRead)
 		if err != nil {
 			return err
 		}
 		inBuffer = append(inBuffer, gotData...)
 		stillNeedToRead -= len(gotData)
+		done := len(inBuffer)
+		if done > reqLen {
+			done = reqLen
+		}
+		ReportProgress(ctx, Progress{Phase: phase, Addr: baseAddr + int64(done), Done: int64(done), Total: int64(reqLen), Started: started})
 	}
 	if len(inBuffer) != reqLen+4 {
 		return fmt.Errorf("wrong lengh of received data (got %d, want %d)", len(inBuffer), len(buf)+4)
@@ -295,11 +374,24 @@ func (cl *ChaosLoader) ReadFlash(baseAddr int64, buf []byte) error {
 	return nil
 }
 
+// readStatus waits for a 2-byte status reply to Write Flash command.
+func (cl *ChaosLoader) readStatus(ctx context.Context, timeout time.Duration, dataLen int, want byte, what string) error {
+	ctx, cancel := cl.pmb.stepContext(ctx, timeout, dataLen)
+	defer cancel()
+	reply := make([]byte, 2)
+	if err := cl.pmb.readFull(ctx, reply); err != nil {
+		return fmt.Errorf("cannot read reply to Write Flash command while %s: %w", what, err)
+	}
+	if !(reply[0] == want && reply[1] == want) {
+		return fmt.Errorf("unexpected result of %s: %v", what, reply)
+	}
+	return nil
+}
+
 // writeWithChecksum writes exactly one block to flash at baseAddr.
-func (cl *ChaosLoader) writeWithChecksum(baseAddr int64, buf []byte) error {
+func (cl *ChaosLoader) writeWithChecksum(ctx context.Context, baseAddr int64, buf []byte) error {
 	writeLen := int64(len(buf))
 	var n int
-	fmt.Printf("writeWithChecksum(0x%08X, <buffer len %08X>): starting\n", baseAddr, writeLen)
 
 	blockAddr, eraseSize, err := cl.bm.ParamsForAddr(baseAddr)
 	if err != nil {
@@ -334,47 +426,38 @@ func (cl *ChaosLoader) writeWithChecksum(baseAddr int64, buf []byte) error {
 	writeBuf = append(writeBuf, buf...)
 	writeBuf = append(writeBuf, chk)
 
-	fmt.Printf("About to send %d bytes on the wire\n", len(writeBuf))
-	if n, err = cl.pmb.iostream.Write(writeBuf); err != nil {
-		return fmt.Errorf("cannot send write flash command: %v", err)
+	if err := cl.pace(ctx); err != nil {
+		return err
+	}
+	ReportProgress(ctx, Progress{Phase: PhaseSending, Addr: baseAddr, Total: writeLen})
+	if n, err = cl.pmb.write(ctx, writeBuf); err != nil {
+		return fmt.Errorf("cannot send write flash command: %w", err)
 	}
 	if n < len(writeBuf) {
 		return fmt.Errorf("short write: %d < %d", n, len(writeBuf))
 	}
-	fmt.Println("Command sent, processing reply...")
-
-	shortDelay()
-	reply := make([]byte, 2)
 	// Wait for "Block sent".
-	if _, err = io.ReadAtLeast(cl.pmb.iostream, reply, 2); err != nil {
-		return fmt.Errorf("cannot read first reply to Write Flash command: %v", err)
-	}
-	if !(reply[0] == 0x01 && reply[1] == 0x01) {
-		return fmt.Errorf("unexpected result of sending block: %v", reply)
+	if err := cl.readStatus(ctx, cl.pmb.timeouts.Reply, len(writeBuf), 0x01, "sending block"); err != nil {
+		return err
 	}
-	fmt.Println(" - Block sent!")
+	ReportProgress(ctx, Progress{Phase: PhaseErasing, Addr: baseAddr, Total: writeLen})
 	// Wait for "block erased".
-	if _, err = io.ReadAtLeast(cl.pmb.iostream, reply, 2); err != nil {
-		return fmt.Errorf("cannot read second reply to Write Flash command: %v", err)
-	}
-	if !(reply[0] == 0x02 && reply[1] == 0x02) {
-		return fmt.Errorf("unexpected result of erasing block: %v", reply)
+	if err := cl.readStatus(ctx, cl.pmb.timeouts.Erase, 0, 0x02, "erasing block"); err != nil {
+		return err
 	}
-	fmt.Println(" - Block erased!")
+	ReportProgress(ctx, Progress{Phase: PhaseWriting, Addr: baseAddr, Total: writeLen})
 	// Wait for "block written".
-	if _, err = io.ReadAtLeast(cl.pmb.iostream, reply, 2); err != nil {
-		return fmt.Errorf("cannot read third reply to Write Flash command: %v", err)
-	}
-	if !(reply[0] == 0x03 && reply[1] == 0x03) {
-		return fmt.Errorf("unexpected result of writing block: %v", reply)
+	if err := cl.readStatus(ctx, cl.pmb.timeouts.Erase, 0, 0x03, "writing block"); err != nil {
+		return err
 	}
-	fmt.Println(" - Block written!")
+	extraCtx, cancel := cl.pmb.stepContext(ctx, cl.pmb.timeouts.Reply, 0)
+	defer cancel()
 	extraReplyBytes := make([]byte, 4)
-	if n, err = io.ReadAtLeast(cl.pmb.iostream, extraReplyBytes, 4); err != nil {
-		return fmt.Errorf("cannot read extra reply bytes: n=%d, %v", n, err)
+	if err := cl.pmb.readFull(extraCtx, extraReplyBytes); err != nil {
+		return fmt.Errorf("cannot read extra reply bytes: %w", err)
 	}
-	fmt.Printf("Read noch %d extra bytes: %X\n", n, extraReplyBytes[:n])
-	ok, err := cl.Ping()
+	log.Printf("Extra reply bytes after writing block @ 0x%08X: %X", baseAddr, extraReplyBytes)
+	ok, err := cl.Ping(ctx)
 	if err != nil {
 		return err
 	}
@@ -386,9 +469,9 @@ func (cl *ChaosLoader) writeWithChecksum(baseAddr int64, buf []byte) error {
 
 // WriteFlash writes a memory region to Flash.
 // both baseAddr and the end address should be aligned on block boundary.
-func (cl *ChaosLoader) WriteFlash(baseAddr int64, buf []byte) error {
+func (cl *ChaosLoader) WriteFlash(ctx context.Context, baseAddr int64, buf []byte) error {
 	if cl.bm == nil {
-		if _, err := cl.ReadInfo(); err != nil {
+		if _, err := cl.ReadInfo(ctx); err != nil {
 			return err
 		}
 	}
@@ -404,23 +487,65 @@ func (cl *ChaosLoader) WriteFlash(baseAddr int64, buf []byte) error {
 	stillNeedToWrite := int64(len(buf))
 	writeFromAddr := int64(0)
 	writeToAddr := baseAddr
+	var badBlocks []int64
+	op := StartOperation(ctx, writeLen)
 	for stillNeedToWrite > 0 {
 		blockAddr, eraseSize, err := cl.bm.ParamsForAddr(writeToAddr)
 		if err != nil {
 			return err
 		}
-		fmt.Printf("Writing 0x%X bytes @ 0x%08X. Slice [0x%08X:0x%08X]\n", eraseSize, writeToAddr, writeFromAddr, writeFromAddr+eraseSize)
 		writeBuf := buf[writeFromAddr : writeFromAddr+eraseSize]
-		if err := cl.writeWithChecksum(blockAddr, writeBuf); err != nil {
+		stepCtx := op.Step(ctx)
+		if err := cl.writeWithChecksum(stepCtx, blockAddr, writeBuf); err != nil {
 			return err
 		}
+		if cl.verifyWrites {
+			ok, err := cl.verifyBlock(stepCtx, blockAddr, writeBuf)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				badBlocks = append(badBlocks, blockAddr)
+			}
+		}
+		op.Advance(eraseSize)
 		writeFromAddr += eraseSize
 		writeToAddr += eraseSize
 		stillNeedToWrite -= eraseSize
 	}
+	if len(badBlocks) > 0 {
+		return &VerifyError{BadBlocks: badBlocks}
+	}
 	return nil
 }
 
+// verifyBlock reads the block at blockAddr back and compares it with want.
+// If the contents differ, the block is written again, up to cl.verifyRetries times.
+// Returns false if the block is still wrong after all retries.
+func (cl *ChaosLoader) verifyBlock(ctx context.Context, blockAddr int64, want []byte) (bool, error) {
+	readBuf := make([]byte, len(want))
+	retry := 0
+	retryCtx := WithProgress(ctx, ProgressFunc(func(p Progress) {
+		p.Retries = retry
+		ReportProgress(ctx, p)
+	}))
+	for ; ; retry++ {
+		if err := cl.readFlash(retryCtx, blockAddr, readBuf, PhaseVerifying); err != nil {
+			return false, fmt.Errorf("cannot read back block @ 0x%08X: %w", blockAddr, err)
+		}
+		if bytes.Equal(readBuf, want) {
+			return true, nil
+		}
+		if retry >= cl.verifyRetries {
+			log.Printf("Block @ 0x%08X is still wrong after %d retries", blockAddr, retry)
+			return false, nil
+		}
+		if err := cl.writeWithChecksum(retryCtx, blockAddr, want); err != nil {
+			return false, err
+		}
+	}
+}
+
 // validateBlockToWrite validates if a block starting at baseAddr with size blockLen
 // would align with the erase regions in the flash described by bm.
 func validateBlockToWrite(bm *blockman.Blockman, baseAddr, blockLen int64) error {
@@ -437,6 +562,10 @@ func validateBlockToWrite(bm *blockman.Blockman, baseAddr, blockLen int64) error
 	if err != nil {
 		return err
 	}
+	if lastAddr == bm.EndAddr() {
+		// The last block of the flash.
+		return nil
+	}
 	blockAddrForLastAddrPlus1, _, err := bm.ParamsForAddr(lastAddr + 1)
 	if err != nil {
 		return err
@@ -448,12 +577,15 @@ func validateBlockToWrite(bm *blockman.Blockman, baseAddr, blockLen int64) error
 	return nil
 }
 
-// ParseChaosInfo parses an info dump saved in a file into a structure.
-// TODO: Accept an io.Reader, not a path to file; return error as the second return value.
+// ParseChaosInfo parses an info dump (a reply to "info" command, maybe saved in a file) into a structure.
 func ParseChaosInfo(r io.Reader) (ChaosPhoneInfo, error) {
+	rawInfo, err := io.ReadAll(r)
+	if err != nil {
+		return ChaosPhoneInfo{}, err
+	}
 
 	var info chaosInfo
-	if err := binary.Read(r, binary.LittleEndian, &info); err != nil {
+	if err := binary.Read(bytes.NewReader(rawInfo), binary.LittleEndian, &info); err != nil {
 		fmt.Println("failed to Read:", err)
 		return ChaosPhoneInfo{}, err
 	}
@@ -462,6 +594,15 @@ func ParseChaosInfo(r io.Reader) (ChaosPhoneInfo, error) {
 		ModelName:    string(info.ModelName[:]),
 		Manufacturer: string(info.Manufacturer[:]),
 		IMEI:         string(info.IMEI[:]),
+		FlashChip: FlashChipInfo{
+			ManufacturerID: uint16(info.Flash0Type & 0xFFFF),
+			DeviceID:       uint16(info.Flash0Type >> 16),
+			SizePow:        info.FlashSizePow,
+			WriteBufSize:   info.WriteBufSize,
+		},
+		Reserved0: info.Reserved0,
+		Reserved1: info.Reserved1,
+		RawInfo:   rawInfo,
 	}
 
 	phoneInfo.BlockMap = blockman.New(int64(info.FlashBaseAddr))
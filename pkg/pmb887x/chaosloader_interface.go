@@ -1,10 +1,14 @@
 package pmb887x
 
+import "context"
+
+// ChaosLoaderInterface is implemented by everything that talks like Chaos bootloader.
+// All operations stop and return ctx.Err() when ctx is done.
 type ChaosLoaderInterface interface {
-	Activate() error
-	Ping() (bool, error)
-	SetSpeed(speed int, speedSetter SpeedSetterFunc) error
-	ReadInfo() (ChaosPhoneInfo, error)
-	ReadFlash(baseAddr int64, buf []byte) error
-	WriteFlash(baseAddr int64, buf []byte) error
+	Activate(ctx context.Context) error
+	Ping(ctx context.Context) (bool, error)
+	SetSpeed(ctx context.Context, speed int, speedSetter SpeedSetterFunc) error
+	ReadInfo(ctx context.Context) (ChaosPhoneInfo, error)
+	ReadFlash(ctx context.Context, baseAddr int64, buf []byte) error
+	WriteFlash(ctx context.Context, baseAddr int64, buf []byte) error
 }
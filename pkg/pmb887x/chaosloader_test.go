@@ -2,7 +2,9 @@ package pmb887x
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"testing"
 
 	"github.com/siemens-mobile-hacks/siepatcher/pkg/blockman"
@@ -14,18 +16,24 @@ func TestParseChaosInfo(t *testing.T) {
 		chaosReply       string
 		wantFlashSize    int64
 		wantFlashRegions int
+		wantBlockmap     blockman.Blockman
+		wantFlashChip    string
 	}{
 		{
 			descr:            "EL71, 64MB, one flash region",
 			chaosReply:       "454C37310000000000000000000000005349454D454E53000000000000000000585858585858585858585858585858008F77473E07433B6A6AA7A8BC4217BD5A000000A0A975DC16000300000000000020001988010A0201FF000004FFFFFFFFFFFFFFFFFFFFFFFF000000000000000000000000000000000000000000000000",
 			wantFlashSize:    64 * 1024 * 1024,
 			wantFlashRegions: 1,
+			wantBlockmap:     blockman.BlockmapForEL71(),
+			wantFlashChip:    "ST/Numonyx M58PR512J",
 		},
 		{
 			descr:            "C81, 64MB, four flash regions",
 			chaosReply:       "433831000000000000000000000000005349454D454E5300000000000000000058585858585858585858585858585800664C544260E5CC2931FBF4799D65BE27000000A003C25490000300000000000089000D8802060004FE0000020300800003008000FE0000025052493133A6000000000000000000000000000000000000",
 			wantFlashSize:    64 * 1024 * 1024,
 			wantFlashRegions: 4,
+			wantBlockmap:     blockman.BlockmapForC81(),
+			wantFlashChip:    "Intel 28F256L18",
 		},
 	}
 
@@ -44,6 +52,15 @@ func TestParseChaosInfo(t *testing.T) {
 		if info.BlockMap.NumOfRegions() != tc.wantFlashRegions {
 			t.Fatalf("Test %q: Unexpected number of regions: got %d, want %d.\nBlockmap: %s", tc.descr, info.BlockMap.NumOfRegions(), tc.wantFlashRegions, info.BlockMap)
 		}
+		if gotChip := info.FlashChip.ManufacturerName() + " " + info.FlashChip.PartName(); gotChip != tc.wantFlashChip {
+			t.Fatalf("Test %q: Unexpected flash chip: got %q, want %q", tc.descr, gotChip, tc.wantFlashChip)
+		}
+		if !bytes.Equal(info.RawInfo, byteData) {
+			t.Fatalf("Test %q: Raw info is not preserved: got %X", tc.descr, info.RawInfo)
+		}
+		if info.BlockMap.String() != tc.wantBlockmap.String() {
+			t.Fatalf("Test %q: Unexpected block map: got\n%s, want\n%s", tc.descr, info.BlockMap, tc.wantBlockmap)
+		}
 	}
 }
 
@@ -97,6 +114,18 @@ func TestValidateBlockForWrite(t *testing.T) {
 			blockLen:  0x20000,
 			wantError: true,
 		},
+		{
+			descr:     "The last block of flash",
+			baseAddr:  0xA3FE0000,
+			blockLen:  0x20000,
+			wantError: false,
+		},
+		{
+			descr:     "A block past the end of flash",
+			baseAddr:  0xA3FE0000,
+			blockLen:  0x40000,
+			wantError: true,
+		},
 	}
 
 	// Create a blockmap with several erase regions (based on a real phone).
@@ -109,3 +138,46 @@ func TestValidateBlockForWrite(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteFlashVerify(t *testing.T) {
+	testCases := []struct {
+		descr      string
+		corrupt    int // Writes that go wrong.
+		retries    int
+		wantWrites int
+		wantBad    bool
+	}{
+		{descr: "Good write is not repeated", corrupt: 0, retries: 2, wantWrites: 1},
+		{descr: "Bad write is rewritten", corrupt: 1, retries: 2, wantWrites: 2},
+		{descr: "Bad write is rewritten until it's right", corrupt: 2, retries: 2, wantWrites: 3},
+		{descr: "Retries run out", corrupt: 3, retries: 2, wantWrites: 3, wantBad: true},
+		{descr: "No retries", corrupt: 1, retries: 0, wantWrites: 1, wantBad: true},
+	}
+
+	block := bytes.Repeat([]byte{0x5A}, 0x400)
+	for _, tc := range testCases {
+		sim := NewSimulator(testBlockmap(), "C81", "354000000000001")
+		cl, cleanup := bootSimulator(t, sim)
+		cl.SetVerify(true, tc.retries)
+		sim.SetFaults(SimFaults{CorruptWrites: tc.corrupt})
+
+		err := cl.WriteFlash(context.Background(), 0xA0000800, block)
+		var verifyErr *VerifyError
+		if tc.wantBad {
+			if !errors.As(err, &verifyErr) || len(verifyErr.BadBlocks) != 1 || verifyErr.BadBlocks[0] != 0xA0000800 {
+				t.Errorf("Test %q: got %v, want VerifyError for block 0xA0000800", tc.descr, err)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("Test %q: write failed: %v", tc.descr, err)
+			}
+			if !bytes.Equal(sim.Flash()[0x800:0xC00], block) {
+				t.Errorf("Test %q: flash contents don't match", tc.descr)
+			}
+		}
+		if got := sim.Writes(); got != tc.wantWrites {
+			t.Errorf("Test %q: block written %d times, want %d", tc.descr, got, tc.wantWrites)
+		}
+		cleanup()
+	}
+}
@@ -0,0 +1,67 @@
+package pmb887x
+
+import "fmt"
+
+// FlashChipInfo identifies the flash IC, as reported by Chaos bootloader.
+type FlashChipInfo struct {
+	ManufacturerID uint16
+	DeviceID       uint16
+	SizePow        byte   // Raw "flashSizePow" field of the info reply.
+	WriteBufSize   uint16 // Raw "writeBufferSize" field of the info reply.
+}
+
+// flashManufacturers maps JEDEC manufacturer IDs to names.
+var flashManufacturers = map[uint16]string{
+	0x0001: "AMD/Spansion",
+	0x0004: "Fujitsu",
+	0x001F: "Atmel",
+	0x0020: "ST/Numonyx",
+	0x0089: "Intel",
+	0x0098: "Toshiba",
+	0x00BF: "SST",
+	0x00C2: "Macronix",
+	0x00EC: "Samsung",
+}
+
+type flashPartID struct {
+	manufacturerID uint16
+	deviceID       uint16
+}
+
+// flashParts maps manufacturer and device IDs to part names.
+var flashParts = map[flashPartID]string{
+	{0x0089, 0x880B}: "28F640L18",
+	{0x0089, 0x880C}: "28F128L18",
+	{0x0089, 0x880D}: "28F256L18",
+	{0x0089, 0x8812}: "28F640L30",
+	{0x0089, 0x8813}: "28F128L30",
+	{0x0089, 0x8814}: "28F256L30",
+	// Numonyx (ST) M18 with 256K blocks, like in EL71.
+	{0x0020, 0x8818}: "M58PR256J",
+	{0x0020, 0x8819}: "M58PR512J",
+	{0x0020, 0x881A}: "M58PR001J",
+	// All Spansion MirrorBit parts report 0x227E, the part is told by extended IDs Chaos doesn't send.
+	{0x0001, 0x227E}: "MirrorBit (S29WS-N/S29NS-N)",
+}
+
+// ManufacturerName returns the name of the flash manufacturer.
+func (f FlashChipInfo) ManufacturerName() string {
+	if name, ok := flashManufacturers[f.ManufacturerID]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown manufacturer 0x%04X", f.ManufacturerID)
+}
+
+// PartName returns the name of the flash IC.
+func (f FlashChipInfo) PartName() string {
+	if name, ok := flashParts[flashPartID{f.ManufacturerID, f.DeviceID}]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown part 0x%04X", f.DeviceID)
+}
+
+// String implements fmt.Stringer.
+func (f FlashChipInfo) String() string {
+	return fmt.Sprintf("%s %s (ID %04X:%04X, size pow 0x%02X, write buffer 0x%04X)",
+		f.ManufacturerName(), f.PartName(), f.ManufacturerID, f.DeviceID, f.SizePow, f.WriteBufSize)
+}
@@ -1,61 +1,268 @@
 package pmb887x
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"sync"
 	"time"
 )
 
+// Timeouts limit how long each step of the protocol may take.
+type Timeouts struct {
+	// Connect is how long to wait for the phone to answer to AT (the user has to press the red button).
+	Connect time.Duration
+	// Reply is how long to wait for a short reply to a command.
+	Reply time.Duration
+	// PerByte is added to Reply for every byte of data transferred by a command.
+	PerByte time.Duration
+	// Erase is how long erasing or programming one flash block may take.
+	Erase time.Duration
+}
+
+// DefaultTimeouts returns timeouts that work with a 115200 baud connection.
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Connect: 2 * time.Minute,
+		Reply:   5 * time.Second,
+		PerByte: 200 * time.Microsecond,
+		Erase:   30 * time.Second,
+	}
+}
+
+// ErrNotConnected is returned when a Device has no stream to talk over.
+var ErrNotConnected = errors.New("device is not connected")
+
+// drainQuiet is how long the line must be silent before the rest of
+// an abandoned reply is considered to be discarded.
+const drainQuiet = 100 * time.Millisecond
+
+// receiver continuously reads from the stream, so that reads can be
+// abandoned when a context is cancelled.
+type receiver struct {
+	ch      chan []byte
+	pending []byte
+	err     error
+	// stale is set when a read was abandoned: the rest of that reply may still arrive.
+	stale bool
+	// done is closed on disconnection, so that nobody waits until what is received is read.
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func startReceiver(r io.Reader) *receiver {
+	rx := &receiver{ch: make(chan []byte, 16), done: make(chan struct{})}
+	go func() {
+		defer close(rx.ch)
+		for {
+			buf := make([]byte, 4096)
+			n, err := r.Read(buf)
+			if n > 0 {
+				select {
+				case rx.ch <- buf[:n]:
+				case <-rx.done:
+					rx.err = ErrNotConnected
+					return
+				}
+			}
+			if err != nil {
+				rx.err = err
+				return
+			}
+		}
+	}()
+	return rx
+}
+
+// stop makes the receiver quit instead of waiting for its data to be read.
+func (rx *receiver) stop() {
+	rx.stopOnce.Do(func() { close(rx.done) })
+}
+
 // Device is an entity that can run bootloaders and interact with us via
 // a simple bi-directional stream of bytes.
 type Device struct {
 	iostream io.ReadWriteCloser
+	rx       *receiver
+	timeouts *Timeouts
 }
 
 func NewPMB(io io.ReadWriteCloser) Device {
+	timeouts := DefaultTimeouts()
 	return Device{
 		iostream: io,
+		rx:       startReceiver(io),
+		timeouts: &timeouts,
+	}
+}
+
+// SetTimeouts changes the timeouts of all protocol steps.
+func (pmb *Device) SetTimeouts(t Timeouts) {
+	*pmb.timeouts = t
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func shortDelay() {
-	time.Sleep(100 * time.Millisecond)
+// stepContext returns a context for one protocol step that transfers dataLen bytes.
+func (pmb *Device) stepContext(ctx context.Context, timeout time.Duration, dataLen int) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, timeout+time.Duration(dataLen)*pmb.timeouts.PerByte)
+}
+
+// read reads whatever is available, but at least one byte, like io.Reader.
+func (pmb *Device) read(ctx context.Context, buf []byte) (int, error) {
+	if pmb.rx == nil {
+		return 0, ErrNotConnected
+	}
+	if len(pmb.rx.pending) == 0 {
+		select {
+		case data, ok := <-pmb.rx.ch:
+			if !ok {
+				return 0, pmb.rx.err
+			}
+			pmb.rx.pending = data
+		case <-ctx.Done():
+			pmb.rx.stale = true
+			return 0, ctx.Err()
+		}
+	}
+	n := copy(buf, pmb.rx.pending)
+	pmb.rx.pending = pmb.rx.pending[n:]
+	return n, nil
+}
+
+// readFull reads exactly len(buf) bytes.
+func (pmb *Device) readFull(ctx context.Context, buf []byte) error {
+	for got := 0; got < len(buf); {
+		n, err := pmb.read(ctx, buf[got:])
+		if err != nil {
+			return err
+		}
+		got += n
+	}
+	return nil
+}
+
+// drain discards the rest of a reply left after an abandoned read, so that it
+// isn't taken for the reply to the next command. It waits until nothing was
+// received for drainQuiet, but not longer than the Reply timeout.
+func (pmb *Device) drain(ctx context.Context) error {
+	if pmb.rx == nil || !pmb.rx.stale {
+		return nil
+	}
+	discarded := len(pmb.rx.pending)
+	pmb.rx.pending = nil
+	limit := time.NewTimer(pmb.timeouts.Reply)
+	defer limit.Stop()
+	for {
+		quiet := time.NewTimer(drainQuiet)
+		select {
+		case data, ok := <-pmb.rx.ch:
+			quiet.Stop()
+			if !ok {
+				return pmb.rx.err
+			}
+			discarded += len(data)
+			continue
+		case <-quiet.C:
+			if discarded > 0 {
+				log.Printf("Discarded %d bytes left from an abandoned reply", discarded)
+			}
+			pmb.rx.stale = false
+			return nil
+		case <-limit.C:
+			quiet.Stop()
+			return fmt.Errorf("the line doesn't get quiet after an abandoned reply, discarded %d bytes", discarded)
+		case <-ctx.Done():
+			quiet.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// writeDeadliner is implemented by streams whose writes can time out, like net.Conn.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// write sends buf unless ctx is already done.
+// If the stream supports write deadlines, a write blocked past the deadline of ctx
+// fails; otherwise (e.g. a serial port) a Write that has started can't be interrupted,
+// and cancelling ctx only takes effect at the next step.
+func (pmb *Device) write(ctx context.Context, buf []byte) (int, error) {
+	if pmb.iostream == nil {
+		return 0, ErrNotConnected
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if d, ok := pmb.iostream.(writeDeadliner); ok {
+		if deadline, ok := ctx.Deadline(); ok && d.SetWriteDeadline(deadline) == nil {
+			defer d.SetWriteDeadline(time.Time{})
+		}
+	}
+	return pmb.iostream.Write(buf)
 }
 
 // LoadBoot initializes PMB serial communication and sends the bootloader.
-func (pmb *Device) LoadBoot(bootcode []byte) error {
+func (pmb *Device) LoadBoot(ctx context.Context, bootcode []byte) error {
 	log.Println("Initializing connection")
 
 	var buf []byte = make([]byte, 1)
 	var deviceType byte
 	fmt.Println("Press RED button!")
-	stopAT := false
 
 	// Start spamming our device with a bunch of ATs.
+	atCtx, stopAT := context.WithCancel(ctx)
+	var atWG sync.WaitGroup
+	atWG.Add(1)
+	started := time.Now()
 	go func() {
-		for {
-			if stopAT {
-				return
-			}
-			if _, err := pmb.iostream.Write([]byte("AT")); err != nil {
+		defer atWG.Done()
+		for attempt := 0; ; attempt++ {
+			if _, err := pmb.write(atCtx, []byte("AT")); err != nil && atCtx.Err() == nil {
 				fmt.Printf("error writing to client: %v", err)
 			}
-			fmt.Print(".")
-			shortDelay()
+			ReportProgress(ctx, Progress{Phase: PhaseConnecting, Retries: attempt, Started: started})
+			select {
+			case <-atCtx.Done():
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
 		}
 	}()
+	stopSpammingAT := func() {
+		stopAT()
+		atWG.Wait()
+	}
+	defer stopSpammingAT()
 
 	// Read a phone type from the interface.
+	connectCtx, cancel := context.WithTimeout(ctx, pmb.timeouts.Connect)
+	defer cancel()
 	for {
-		_, err := pmb.iostream.Read(buf)
+		_, err := pmb.read(connectCtx, buf)
 		if err != nil {
-			return fmt.Errorf("error reading from client: %v", err)
+			return fmt.Errorf("error reading from client: %w", err)
 		}
 		deviceType = buf[0]
 		if deviceType == 0xB0 || deviceType == 0xC0 {
-			fmt.Println("\nConnected!")
-			stopAT = true
+			fmt.Println("Connected!")
+			stopSpammingAT()
 			break
 		}
 	}
@@ -85,21 +292,20 @@ func (pmb *Device) LoadBoot(bootcode []byte) error {
 
 	// Send payload.
 	log.Println("Sending payload")
+	started = time.Now()
 	for i := 0; i < len(payload); i++ {
-		if _, err := pmb.iostream.Write([]byte{payload[i]}); err != nil {
-			return fmt.Errorf("error writing payload: %v", err)
+		if _, err := pmb.write(ctx, []byte{payload[i]}); err != nil {
+			return fmt.Errorf("error writing payload: %w", err)
 		}
-		fmt.Print(".")
+		ReportProgress(ctx, Progress{Phase: PhaseBooting, Done: int64(i + 1), Total: int64(len(payload)), Started: started})
 	}
-	fmt.Println()
-
-	// Give bootloader some time to init.
-	shortDelay()
 
 	fmt.Println("Waiting for ACK")
-	n, err := pmb.iostream.Read(buf)
+	ackCtx, cancel := pmb.stepContext(ctx, pmb.timeouts.Reply, 0)
+	defer cancel()
+	n, err := pmb.read(ackCtx, buf)
 	if err != nil {
-		return fmt.Errorf("error reading from client: %v", err)
+		return fmt.Errorf("error reading from client: %w", err)
 	}
 	log.Printf("Read %d bytes", n)
 	ack := buf[0]
@@ -115,5 +321,11 @@ func (pmb *Device) LoadBoot(bootcode []byte) error {
 }
 
 func (pmb *Device) Disconnect() error {
+	if pmb.iostream == nil {
+		return ErrNotConnected
+	}
+	if pmb.rx != nil {
+		pmb.rx.stop()
+	}
 	return pmb.iostream.Close()
 }
@@ -0,0 +1,130 @@
+package pmb887x
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Phase is what a long operation is busy with at the moment.
+type Phase int
+
+const (
+	PhaseConnecting Phase = iota // Waiting for the phone to answer.
+	PhaseBooting                 // Sending the bootcode.
+	PhaseReading                 // Reading flash.
+	PhaseSending                 // Sending a block to write.
+	PhaseErasing                 // Waiting for a block to be erased.
+	PhaseWriting                 // Waiting for a block to be written.
+	PhaseVerifying               // Reading a written block back.
+)
+
+var phaseNames = []string{"connecting", "booting", "reading", "sending", "erasing", "writing", "verifying"}
+
+func (p Phase) String() string {
+	if p < 0 || int(p) >= len(phaseNames) {
+		return fmt.Sprintf("phase %d", int(p))
+	}
+	return phaseNames[p]
+}
+
+// Progress describes the state of a long operation.
+type Progress struct {
+	Phase Phase
+	// Addr is the flash address being worked on.
+	Addr int64
+	// Done bytes of Total are finished. Total is 0 if unknown.
+	Done  int64
+	Total int64
+	// Retries is how many times the current step was retried.
+	Retries int
+	// Started is when the operation began.
+	Started time.Time
+}
+
+// ETA estimates the remaining time from the speed so far. It is 0 if unknown.
+func (p Progress) ETA() time.Duration {
+	if p.Done <= 0 || p.Total <= p.Done || p.Started.IsZero() {
+		return 0
+	}
+	elapsed := time.Since(p.Started)
+	return time.Duration(float64(elapsed) * float64(p.Total-p.Done) / float64(p.Done))
+}
+
+// String implements fmt.Stringer.
+func (p Progress) String() string {
+	s := fmt.Sprintf("%s @ 0x%08X", p.Phase, p.Addr)
+	if p.Total > 0 {
+		s += fmt.Sprintf(": %d%% (0x%X of 0x%X bytes)", p.Done*100/p.Total, p.Done, p.Total)
+	}
+	if eta := p.ETA().Round(time.Second); eta > 0 {
+		s += fmt.Sprintf(", ETA %v", eta)
+	}
+	if p.Retries > 0 {
+		s += fmt.Sprintf(", retry %d", p.Retries)
+	}
+	return s
+}
+
+// ProgressReporter receives progress of long operations.
+type ProgressReporter interface {
+	Report(p Progress)
+}
+
+// ProgressFunc is a function that implements ProgressReporter.
+type ProgressFunc func(p Progress)
+
+// Report implements ProgressReporter.
+func (f ProgressFunc) Report(p Progress) {
+	f(p)
+}
+
+type progressKey struct{}
+
+// WithProgress returns a context that makes all operations running with it report progress to r.
+func WithProgress(ctx context.Context, r ProgressReporter) context.Context {
+	return context.WithValue(ctx, progressKey{}, r)
+}
+
+// ReportProgress sends p to the reporter set with WithProgress, if any.
+func ReportProgress(ctx context.Context, p Progress) {
+	if r, ok := ctx.Value(progressKey{}).(ProgressReporter); ok {
+		r.Report(p)
+	}
+}
+
+// Operation combines progress of the steps of a long operation, like
+// writing many blocks one by one, into progress of the whole operation.
+type Operation struct {
+	ctx     context.Context
+	total   int64
+	done    int64
+	started time.Time
+}
+
+// StartOperation starts an operation of total bytes reporting progress to the reporter in ctx.
+func StartOperation(ctx context.Context, total int64) *Operation {
+	return &Operation{ctx: ctx, total: total, started: time.Now()}
+}
+
+// Step returns a context for the next step of the operation.
+// Progress reported by the step is counted on top of what's already done.
+func (op *Operation) Step(ctx context.Context) context.Context {
+	done := op.done
+	return WithProgress(ctx, ProgressFunc(func(p Progress) {
+		p.Done += done
+		p.Total = op.total
+		p.Started = op.started
+		ReportProgress(op.ctx, p)
+	}))
+}
+
+// Advance marks n more bytes of the operation as done.
+func (op *Operation) Advance(n int64) {
+	op.done += n
+}
+
+// Report reports the progress of the operation itself.
+func (op *Operation) Report(phase Phase, addr int64, retries int) {
+	ReportProgress(op.ctx, Progress{Phase: phase, Addr: addr, Done: op.done, Total: op.total, Retries: retries, Started: op.started})
+}
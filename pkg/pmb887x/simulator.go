@@ -0,0 +1,365 @@
+package pmb887x
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/blockman"
+)
+
+// SimFaults describes errors the Simulator injects into the protocol.
+// Every counter is decremented when the corresponding fault is injected.
+type SimFaults struct {
+	// RejectBoot makes the boot ROM reject the bootcode.
+	RejectBoot bool
+	// BadReadChecksum corrupts the checksum of the next N replies to Read Flash.
+	BadReadChecksum int
+	// DropReadBytes drops one byte from the next N replies to Read Flash.
+	DropReadBytes int
+	// LateReads sends the next N replies to Read Flash after LateReadDelay.
+	LateReads     int
+	LateReadDelay time.Duration
+	// NakWrites rejects the next N Write Flash commands.
+	NakWrites int
+	// CorruptWrites silently stores wrong data for the next N Write Flash commands.
+	CorruptWrites int
+}
+
+// Simulator is an in-process PMB887x boot ROM with Chaos bootloader.
+// It keeps flash contents in memory and speaks the same protocol as a real
+// phone over the stream returned by Connect.
+type Simulator struct {
+	mu     sync.Mutex
+	bm     blockman.Blockman
+	flash  []byte
+	model  string
+	imei   string
+	faults SimFaults
+	writes int
+	err    error
+	done   chan struct{}
+}
+
+// NewSimulator creates a simulated phone with erased flash of the given geometry.
+func NewSimulator(bm blockman.Blockman, model, imei string) *Simulator {
+	flash := make([]byte, bm.TotalSize())
+	for i := range flash {
+		flash[i] = 0xFF
+	}
+	return &Simulator{
+		bm:    bm,
+		flash: flash,
+		model: model,
+		imei:  imei,
+	}
+}
+
+// SetFaults replaces the faults to inject.
+func (s *Simulator) SetFaults(faults SimFaults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = faults
+}
+
+// Writes returns the number of Write Flash commands received so far.
+func (s *Simulator) Writes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writes
+}
+
+// Flash returns a copy of the simulated flash contents.
+func (s *Simulator) Flash() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte{}, s.flash...)
+}
+
+// SetFlash overwrites the simulated flash starting at offset off.
+func (s *Simulator) SetFlash(off int64, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copy(s.flash[off:], data)
+}
+
+// Connect starts the simulated phone and returns our end of its serial line.
+// The phone is powered off when the stream is closed.
+func (s *Simulator) Connect() io.ReadWriteCloser {
+	ours, theirs := net.Pipe()
+	s.done = make(chan struct{})
+	go s.serve(theirs)
+	return ours
+}
+
+// Wait waits until the simulated phone is powered off and returns the first
+// protocol error it has seen, if any.
+func (s *Simulator) Wait() error {
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Simulator) serve(conn net.Conn) {
+	defer close(s.done)
+	defer conn.Close()
+	err := s.bootROM(conn)
+	if err == nil {
+		err = s.chaos(conn)
+	}
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+	}
+}
+
+func readByte(r io.Reader) (byte, error) {
+	b := []byte{0}
+	_, err := io.ReadFull(r, b)
+	return b[0], err
+}
+
+// bootROM waits for "AT", receives the bootcode and starts it.
+func (s *Simulator) bootROM(conn net.Conn) error {
+	var prev byte
+	for {
+		b, err := readByte(conn)
+		if err != nil {
+			return err
+		}
+		if prev == 'A' && b == 'T' {
+			break
+		}
+		prev = b
+	}
+	if _, err := conn.Write([]byte{0xC0}); err != nil { // SGOLD2.
+		return err
+	}
+
+	// Skip ATs that are still coming and wait for the bootcode.
+	for {
+		b, err := readByte(conn)
+		if err != nil {
+			return err
+		}
+		if b == 0x30 {
+			break
+		}
+		if b != 'A' && b != 'T' {
+			return fmt.Errorf("unexpected byte 0x%02X while waiting for bootcode", b)
+		}
+	}
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return err
+	}
+	bootcode := make([]byte, int(lenBuf[0])|int(lenBuf[1])<<8)
+	if _, err := io.ReadFull(conn, bootcode); err != nil {
+		return err
+	}
+	chk, err := readByte(conn)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	reject := s.faults.RejectBoot
+	s.mu.Unlock()
+	if reject || chk != xorChecksum(bootcode) {
+		_, err := conn.Write([]byte{0x1C}) // Rejected.
+		return err
+	}
+	if _, err := conn.Write([]byte{0xC1}); err != nil {
+		return err
+	}
+	// Chaos bootloader is ready.
+	_, err = conn.Write([]byte{0xA5})
+	return err
+}
+
+func xorChecksum(data []byte) byte {
+	chk := byte(0)
+	for _, b := range data {
+		chk ^= b
+	}
+	return chk
+}
+
+// chaos serves Chaos bootloader commands.
+func (s *Simulator) chaos(conn net.Conn) error {
+	speedChanged := false
+	for {
+		cmd, err := readByte(conn)
+		if err != nil {
+			return err
+		}
+		switch cmd {
+		case 'A':
+			reply := byte('R')
+			if speedChanged {
+				reply = 'H'
+				speedChanged = false
+			}
+			if _, err := conn.Write([]byte{reply}); err != nil {
+				return err
+			}
+		case 'H':
+			if _, err := readByte(conn); err != nil {
+				return err
+			}
+			if _, err := conn.Write([]byte{0x68}); err != nil {
+				return err
+			}
+			speedChanged = true
+		case 'I':
+			info, err := s.infoReply()
+			if err != nil {
+				return err
+			}
+			if _, err := conn.Write(info); err != nil {
+				return err
+			}
+		case 'R':
+			if err := s.readFlash(conn); err != nil {
+				return err
+			}
+		case 'F':
+			if err := s.writeFlash(conn); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown Chaos command 0x%02X", cmd)
+		}
+	}
+}
+
+// infoReply builds a reply to "info" command.
+func (s *Simulator) infoReply() ([]byte, error) {
+	g := s.bm.Geometry()
+	if len(g.Regions) > 6 {
+		return nil, fmt.Errorf("too many flash regions: %d", len(g.Regions))
+	}
+	info := chaosInfo{
+		FlashBaseAddr:   uint32(g.BaseAddr),
+		Flash0Type:      0x880D0089,
+		FlashRegionsNum: byte(len(g.Regions)),
+	}
+	copy(info.ModelName[:], s.model)
+	copy(info.Manufacturer[:], "SIEMENS")
+	copy(info.IMEI[:], s.imei)
+	regionFields := []struct{ blocksNumMinus1, blockSizeDiv256 *uint16 }{
+		{&info.FlashRegion0BlocksNumMinus1, &info.FlashRegion0BlockSizeDiv256},
+		{&info.FlashRegion1BlocksNumMinus1, &info.FlashRegion1BlockSizeDiv256},
+		{&info.FlashRegion2BlocksNumMinus1, &info.FlashRegion2BlockSizeDiv256},
+		{&info.FlashRegion3BlocksNumMinus1, &info.FlashRegion3BlockSizeDiv256},
+		{&info.FlashRegion4BlocksNumMinus1, &info.FlashRegion4BlockSizeDiv256},
+		{&info.FlashRegion5BlocksNumMinus1, &info.FlashRegion5BlockSizeDiv256},
+	}
+	for i, reg := range g.Regions {
+		*regionFields[i].blocksNumMinus1 = uint16(reg.BlockCount - 1)
+		*regionFields[i].blockSizeDiv256 = uint16(reg.BlockSize / 256)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, info); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 128)
+	copy(reply, buf.Bytes())
+	return reply, nil
+}
+
+func readCmdArgs(r io.Reader) (int64, int64, error) {
+	args := make([]byte, 8)
+	if _, err := io.ReadFull(r, args); err != nil {
+		return 0, 0, err
+	}
+	return int64(binary.BigEndian.Uint32(args[0:4])), int64(binary.BigEndian.Uint32(args[4:8])), nil
+}
+
+func (s *Simulator) readFlash(conn net.Conn) error {
+	addr, size, err := readCmdArgs(conn)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	reply := make([]byte, size, size+4)
+	off := addr - s.bm.BaseAddr()
+	okSign := []byte{'O', 'K'}
+	if off < 0 || off+size > int64(len(s.flash)) {
+		okSign = []byte{'E', 'R'}
+	} else {
+		copy(reply, s.flash[off:off+size])
+	}
+	chk := xorChecksum(reply)
+	if s.faults.BadReadChecksum > 0 {
+		s.faults.BadReadChecksum--
+		chk ^= 0xFF
+	}
+	reply = append(reply, okSign...)
+	reply = append(reply, chk, 0x00)
+	if s.faults.DropReadBytes > 0 {
+		s.faults.DropReadBytes--
+		reply = reply[1:]
+	}
+	var delay time.Duration
+	if s.faults.LateReads > 0 {
+		s.faults.LateReads--
+		delay = s.faults.LateReadDelay
+	}
+	s.mu.Unlock()
+
+	time.Sleep(delay)
+
+	_, err = conn.Write(reply)
+	return err
+}
+
+func (s *Simulator) writeFlash(conn net.Conn) error {
+	addr, size, err := readCmdArgs(conn)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return err
+	}
+	chk, err := readByte(conn)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.writes++
+	blockAddr, blockSize, mapErr := s.bm.ParamsForAddr(addr)
+	nak := mapErr != nil || blockAddr != addr || blockSize != size || chk != xorChecksum(data)
+	if s.faults.NakWrites > 0 {
+		s.faults.NakWrites--
+		nak = true
+	}
+	if !nak {
+		off := addr - s.bm.BaseAddr()
+		copy(s.flash[off:off+size], data)
+		if s.faults.CorruptWrites > 0 {
+			s.faults.CorruptWrites--
+			s.flash[off] ^= 0xFF
+		}
+	}
+	s.mu.Unlock()
+
+	if nak {
+		_, err := conn.Write([]byte{0xEE, 0xEE})
+		return err
+	}
+	// Block received, erased, written; then some extra status bytes.
+	_, err = conn.Write([]byte{0x01, 0x01, 0x02, 0x02, 0x03, 0x03, 0x00, 0x00, 0x00, 0x00})
+	return err
+}
@@ -0,0 +1,278 @@
+package pmb887x
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/siemens-mobile-hacks/siepatcher/pkg/blockman"
+)
+
+// A tiny "bootcode", the simulator doesn't run it anyway.
+var testBootcode = []byte{0xDE, 0xAD, 0xBE, 0xEF}
+
+func testBlockmap() blockman.Blockman {
+	bm := blockman.New(0xA0000000)
+	bm.AddRegion(0x400, 8)
+	bm.AddRegion(0x1000, 2)
+	return bm
+}
+
+// bootSimulator connects to a simulated phone, loads Chaos and activates it.
+func bootSimulator(t testing.TB, sim *Simulator) (*ChaosLoader, func()) {
+	t.Helper()
+	ctx := context.Background()
+	dev := NewPMB(sim.Connect())
+	if err := dev.LoadBoot(ctx, testBootcode); err != nil {
+		t.Fatalf("Cannot load boot: %v", err)
+	}
+	cl := ChaosControllerForDevice(dev)
+	if err := cl.Activate(ctx); err != nil {
+		t.Fatalf("Cannot activate Chaos: %v", err)
+	}
+	return cl, func() {
+		dev.Disconnect()
+		if err := sim.Wait(); err != nil {
+			t.Errorf("Simulator failed: %v", err)
+		}
+	}
+}
+
+func TestSimulatorReadWrite(t *testing.T) {
+	sim := NewSimulator(testBlockmap(), "C81", "354000000000001")
+	cl, cleanup := bootSimulator(t, sim)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := cl.SetSpeed(ctx, 921600, func() error { return nil }); err != nil {
+		t.Fatalf("Cannot set speed: %v", err)
+	}
+	info, err := cl.ReadInfo(ctx)
+	if err != nil {
+		t.Fatalf("Cannot read info: %v", err)
+	}
+	wantBM := testBlockmap()
+	if info.BlockMap.String() != wantBM.String() || info.ModelName[:3] != "C81" {
+		t.Fatalf("Unexpected info: %s", info)
+	}
+
+	// The last block of the first region and the first block of the second one.
+	block := bytes.Repeat([]byte{0x12, 0x34}, 0xA00)
+	if err := cl.WriteFlash(ctx, 0xA0001C00, block); err != nil {
+		t.Fatalf("Cannot write flash: %v", err)
+	}
+	if !bytes.Equal(sim.Flash()[0x1C00:0x3000], block) {
+		t.Fatalf("Flash contents don't match after write")
+	}
+
+	readBuf := make([]byte, 0x10)
+	if err := cl.ReadFlash(ctx, 0xA0001FF8, readBuf); err != nil {
+		t.Fatalf("Cannot read flash: %v", err)
+	}
+	if !bytes.Equal(readBuf, block[0x3F8:0x408]) {
+		t.Fatalf("Got %X from flash, want %X", readBuf, block[0x3F8:0x408])
+	}
+
+	// Misaligned writes never reach the phone.
+	if err := cl.WriteFlash(ctx, 0xA0000100, block[:0x400]); err == nil {
+		t.Fatalf("Expected a misaligned write to fail")
+	}
+}
+
+func TestSimulatorFaults(t *testing.T) {
+	sim := NewSimulator(testBlockmap(), "C81", "354000000000001")
+	cl, cleanup := bootSimulator(t, sim)
+	defer cleanup()
+	ctx := context.Background()
+
+	sim.SetFaults(SimFaults{BadReadChecksum: 1})
+	if err := cl.ReadFlash(ctx, 0xA0000000, make([]byte, 0x10)); err == nil {
+		t.Errorf("Expected a read with a bad checksum to fail")
+	}
+	if err := cl.ReadFlash(ctx, 0xA0000000, make([]byte, 0x10)); err != nil {
+		t.Errorf("Cannot read flash after a bad checksum: %v", err)
+	}
+
+	block := bytes.Repeat([]byte{0x55}, 0x400)
+	sim.SetFaults(SimFaults{NakWrites: 1})
+	if err := cl.WriteFlash(ctx, 0xA0000000, block); err == nil {
+		t.Errorf("Expected a rejected write to fail")
+	}
+
+	// A write that silently goes wrong is detected and fixed by verification.
+	cl.SetVerify(true, 1)
+	sim.SetFaults(SimFaults{CorruptWrites: 1})
+	if err := cl.WriteFlash(ctx, 0xA0000000, block); err != nil {
+		t.Errorf("Write with verification failed: %v", err)
+	}
+	if !bytes.Equal(sim.Flash()[:0x400], block) {
+		t.Errorf("Flash contents don't match after a verified write")
+	}
+
+	// And if it goes wrong every time, the bad block is reported.
+	sim.SetFaults(SimFaults{CorruptWrites: 2})
+	err := cl.WriteFlash(ctx, 0xA0000400, block)
+	var verifyErr *VerifyError
+	if !errors.As(err, &verifyErr) || len(verifyErr.BadBlocks) != 1 || verifyErr.BadBlocks[0] != 0xA0000400 {
+		t.Errorf("Got %v, want VerifyError for block 0xA0000400", err)
+	}
+}
+
+func TestSimulatorRejectsBoot(t *testing.T) {
+	sim := NewSimulator(testBlockmap(), "C81", "354000000000001")
+	sim.SetFaults(SimFaults{RejectBoot: true})
+	dev := NewPMB(sim.Connect())
+	defer dev.Disconnect()
+	if err := dev.LoadBoot(context.Background(), testBootcode); err == nil {
+		t.Fatalf("Expected bootcode to be rejected")
+	}
+}
+
+func TestSimulatorTimeouts(t *testing.T) {
+	sim := NewSimulator(testBlockmap(), "C81", "354000000000001")
+	cl, cleanup := bootSimulator(t, sim)
+	defer cleanup()
+	ctx := context.Background()
+	cl.pmb.SetTimeouts(Timeouts{Connect: time.Second, Reply: 300 * time.Millisecond, Erase: time.Second})
+
+	// A reply that is one byte short would block forever without a timeout.
+	sim.SetFaults(SimFaults{DropReadBytes: 1})
+	if err := cl.ReadFlash(ctx, 0xA0000000, make([]byte, 0x10)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Got %v reading a short reply, want %v", err, context.DeadlineExceeded)
+	}
+	if err := cl.ReadFlash(ctx, 0xA0000000, make([]byte, 0x10)); err != nil {
+		t.Errorf("Cannot read flash after a timeout: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := cl.WriteFlash(cancelled, 0xA0000000, bytes.Repeat([]byte{0x55}, 0x400)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Got %v writing with a cancelled context, want %v", err, context.Canceled)
+	}
+	if sim.Flash()[0] != 0xFF {
+		t.Errorf("Flash was written with a cancelled context")
+	}
+}
+
+func TestSimulatorLateReply(t *testing.T) {
+	sim := NewSimulator(testBlockmap(), "C81", "354000000000001")
+	cl, cleanup := bootSimulator(t, sim)
+	defer cleanup()
+	ctx := context.Background()
+	cl.pmb.SetTimeouts(Timeouts{Connect: time.Second, Reply: 300 * time.Millisecond, Erase: time.Second})
+	want := bytes.Repeat([]byte{0x42}, 0x10)
+	sim.SetFlash(0x400, want)
+
+	// The reply comes after we gave up on it, and must not be taken for the next one.
+	sim.SetFaults(SimFaults{LateReads: 1, LateReadDelay: 350 * time.Millisecond})
+	if err := cl.ReadFlash(ctx, 0xA0000000, make([]byte, 0x10)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Got %v reading a late reply, want %v", err, context.DeadlineExceeded)
+	}
+	got := make([]byte, 0x10)
+	if err := cl.ReadFlash(ctx, 0xA0000400, got); err != nil {
+		t.Fatalf("Cannot read flash after a late reply: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Read %X after a late reply, want %X", got, want)
+	}
+}
+
+// chattyStream sends data forever and ignores Close.
+type chattyStream struct{}
+
+func (chattyStream) Read(buf []byte) (int, error)  { return len(buf), nil }
+func (chattyStream) Write(buf []byte) (int, error) { return len(buf), nil }
+func (chattyStream) Close() error                  { return nil }
+
+func TestDisconnectStopsReceiver(t *testing.T) {
+	dev := NewPMB(chattyStream{})
+	// Nobody reads what's received, like after an abandoned read.
+	time.Sleep(50 * time.Millisecond)
+	dev.Disconnect()
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-dev.rx.ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Receiver still runs after Disconnect")
+		}
+	}
+}
+
+func TestLoadBootCancel(t *testing.T) {
+	// A phone that never answers.
+	ours, theirs := net.Pipe()
+	go io.Copy(io.Discard, theirs)
+	dev := NewPMB(ours)
+	defer dev.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := dev.LoadBoot(ctx, testBootcode); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// BenchmarkReadFlash reads flash in small pieces, like patching does,
+// with and without the delay the protocol used to make before every command.
+func BenchmarkReadFlash(b *testing.B) {
+	for _, delay := range []time.Duration{0, 100 * time.Millisecond} {
+		b.Run(fmt.Sprintf("delay=%v", delay), func(b *testing.B) {
+			sim := NewSimulator(testBlockmap(), "C81", "354000000000001")
+			cl, cleanup := bootSimulator(b, sim)
+			defer cleanup()
+			cl.SetCommandDelay(delay)
+			ctx := context.Background()
+			buf := make([]byte, 0x100)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := cl.ReadFlash(ctx, 0xA0000000, buf); err != nil {
+					b.Fatalf("Cannot read flash: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestSimulatorProgress(t *testing.T) {
+	sim := NewSimulator(testBlockmap(), "C81", "354000000000001")
+	cl, cleanup := bootSimulator(t, sim)
+	defer cleanup()
+	cl.SetVerify(true, 1)
+
+	var events []Progress
+	ctx := WithProgress(context.Background(), ProgressFunc(func(p Progress) {
+		events = append(events, p)
+	}))
+	if err := cl.WriteFlash(ctx, 0xA0000000, bytes.Repeat([]byte{0x55}, 0x800)); err != nil {
+		t.Fatalf("Cannot write flash: %v", err)
+	}
+
+	seen := map[Phase]bool{}
+	var done int64
+	for _, p := range events {
+		seen[p.Phase] = true
+		if p.Total != 0x800 || p.Done < done || p.Started.IsZero() {
+			t.Fatalf("Unexpected progress event %+v after 0x%X bytes done", p, done)
+		}
+		done = p.Done
+	}
+	for _, phase := range []Phase{PhaseSending, PhaseErasing, PhaseWriting, PhaseVerifying} {
+		if !seen[phase] {
+			t.Errorf("No progress reported for phase %s", phase)
+		}
+	}
+	if done != 0x800 {
+		t.Errorf("Got 0x%X bytes done at the end, want 0x800", done)
+	}
+}